@@ -0,0 +1,180 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+peerList caches the addresses of the trusted peers stored in ORGDIR/PEERSDIR so
+that every incoming message can be authorized without reading the peer files.
+It is refreshed by updatePeers and whenever a peer file is written or removed.
+*/
+type peerList struct {
+	mutex   sync.RWMutex
+	trusted map[string]bool   // addresses of all trusted peers
+	files   map[string]string // address of the trusted peer in each peer file
+	roles   map[string]Role   // assigned roles, see permissions.go
+	revoked map[string]bool   // addresses of revoked peers, see revoke.go
+}
+
+/*
+createPeerList returns an empty peerList.
+*/
+func createPeerList() *peerList {
+	return &peerList{
+		trusted: make(map[string]bool),
+		files:   make(map[string]string),
+		roles:   make(map[string]Role),
+		revoked: make(map[string]bool)}
+}
+
+/*
+isTrusted returns whether the address belongs to a trusted peer.
+*/
+func (pl *peerList) isTrusted(address string) bool {
+	pl.mutex.RLock()
+	defer pl.mutex.RUnlock()
+	return pl.trusted[address]
+}
+
+/*
+role returns the role assigned to the address, RoleAdmin if none is assigned.
+*/
+func (pl *peerList) role(address string) Role {
+	pl.mutex.RLock()
+	defer pl.mutex.RUnlock()
+	role, exists := pl.roles[address]
+	if !exists {
+		return RoleAdmin
+	}
+	return role
+}
+
+/*
+setRoles replaces the cached roles.
+*/
+func (pl *peerList) setRoles(roles map[string]Role) {
+	pl.mutex.Lock()
+	pl.roles = roles
+	pl.mutex.Unlock()
+}
+
+/*
+set replaces the cached peers with the trusted ones of the given peers, keyed by
+the name of their file. Files that could not be read are given as nil and keep
+the address they held before trusted, so that only peers whose file is gone or
+no longer trusts them are dropped. Returns the addresses that were trusted
+before but no longer are.
+*/
+func (pl *peerList) set(peers map[string]*shared.Peer) []string {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	trusted := make(map[string]bool)
+	files := make(map[string]string)
+	for name, peer := range peers {
+		var address string
+		if peer == nil {
+			address = pl.files[name]
+		} else if peer.Trusted {
+			address = peer.Address
+		}
+		if address != "" {
+			trusted[address] = true
+			files[name] = address
+		}
+	}
+	var removed []string
+	for address := range pl.trusted {
+		if !trusted[address] {
+			removed = append(removed, address)
+		}
+	}
+	pl.trusted = trusted
+	pl.files = files
+	return removed
+}
+
+/*
+isAuthorized returns whether the address may lock and access encrypted. Only
+trusted peers other than ourselves that have not been revoked are authorized.
+*/
+func (enc *Encrypted) isAuthorized(address string) bool {
+	if enc.Peer != nil && address == enc.Peer.Address {
+		return false
+	}
+	return enc.peers.isTrusted(address) && !enc.peers.isRevoked(address)
+}
+
+/*
+loadPeers reads all peers from ORGDIR/PEERSDIR, keyed by the name of their file.
+Peer files that can't be read are included as nil, files removed in the
+meantime are skipped.
+*/
+func (enc *Encrypted) loadPeers() (map[string]*shared.Peer, error) {
+	path := enc.RootPath + "/" + shared.ORGDIR + "/" + shared.PEERSDIR
+	peersFiles, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[string]*shared.Peer)
+	for _, stat := range peersFiles {
+		data, err := ioutil.ReadFile(path + "/" + stat.Name())
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Println("Error loading peer " + stat.Name() + " from disk!")
+			peers[stat.Name()] = nil
+			continue
+		}
+		peer := &shared.Peer{}
+		err = json.Unmarshal(data, peer)
+		if err != nil {
+			log.Println("Error unmarshaling peer " + stat.Name() + " from disk!")
+			peers[stat.Name()] = nil
+			continue
+		}
+		peers[stat.Name()] = peer
+	}
+	return peers, nil
+}
+
+/*
+refreshPeers reloads the cached peers and their roles from disk.
+*/
+func (enc *Encrypted) refreshPeers() error {
+	peers, err := enc.loadPeers()
+	if err != nil {
+		return err
+	}
+	enc.setPeers(peers)
+	return enc.refreshRoles()
+}
+
+/*
+setPeers updates the cached peers. Peers that are no longer trusted, because
+their peer file was removed or changed to untrusted, are revoked.
+*/
+func (enc *Encrypted) setPeers(peers map[string]*shared.Peer) {
+	for _, address := range enc.peers.set(peers) {
+		enc.revoke(address)
+	}
+}
+
+/*
+refreshRoles reloads the cached roles from disk.
+*/
+func (enc *Encrypted) refreshRoles() error {
+	roles, err := enc.loadRoles()
+	if err != nil {
+		return err
+	}
+	enc.peers.setRoles(roles)
+	return nil
+}
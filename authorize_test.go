@@ -0,0 +1,125 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestRefreshPeersRevokes(t *testing.T) {
+	enc := createTestEncrypted(t)
+	dir := filepath.Join(enc.RootPath, shared.ORGDIR, shared.PEERSDIR)
+	write := func(name string, data []byte) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePeer := func(name, address string, trusted bool) {
+		data, err := json.Marshal(&shared.Peer{Name: name, Address: address, Trusted: trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(name, data)
+	}
+	for _, name := range []string{"broken", "unreadable", "removed", "untrusted", "moved"} {
+		writePeer(name, name+"-address", true)
+	}
+	if err := enc.refreshPeers(); err != nil {
+		t.Fatal(err)
+	}
+	// the lock of a revoked peer must be cleared
+	enc.lock.release(testAddress)
+	if locked, _ := enc.lock.acquire("removed-address", false); !locked {
+		t.Fatal("failed to acquire lock")
+	}
+	write("broken", []byte("{half written"))
+	if err := os.Chmod(filepath.Join(dir, "unreadable"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	writePeer("untrusted", "untrusted-address", false)
+	writePeer("moved", "new-address", true)
+	if err := enc.refreshPeers(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		address    string
+		authorized bool
+		revoked    bool
+	}{
+		{"broken-address", true, false},
+		{"removed-address", false, true},
+		{"untrusted-address", false, true},
+		{"moved-address", false, true},
+		{"new-address", true, false},
+	}
+	for _, c := range cases {
+		if authorized := enc.isAuthorized(c.address); authorized != c.authorized {
+			t.Errorf("%s: expected authorized %v, got %v", c.address, c.authorized, authorized)
+		}
+		if revoked := enc.peers.isRevoked(c.address); revoked != c.revoked {
+			t.Errorf("%s: expected revoked %v, got %v", c.address, c.revoked, revoked)
+		}
+	}
+	// root can read files regardless of their mode, so this only applies otherwise
+	if os.Geteuid() != 0 && !enc.isAuthorized("unreadable-address") {
+		t.Error("expected peer of unreadable file to stay authorized")
+	}
+	if enc.lock.current("removed-address") != 0 {
+		t.Error("expected lock of revoked peer to be cleared")
+	}
+	// the broken file keeps its peer trusted until it is fixed or removed
+	if err := os.Remove(filepath.Join(dir, "broken")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.refreshPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if enc.isAuthorized("broken-address") || !enc.peers.isRevoked("broken-address") {
+		t.Error("expected peer of removed broken file to be revoked")
+	}
+}
+
+func TestRevokeCancelsTransfers(t *testing.T) {
+	for _, viaRevoke := range []bool{true, false} {
+		enc := createTestEncrypted(t)
+		c := enc.cInterface
+		pm := pushMessage{PushMessage: shared.CreatePushMessage("object", shared.OtObject)}
+		c.OnMessage(testAddress, pm.JSON())
+		allowed, path := c.OnAllowFile(testAddress, "object")
+		if !allowed {
+			t.Fatal("expected file to be allowed")
+		}
+		if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key := c.buildKey(testAddress, "object")
+		if viaRevoke {
+			enc.revoke(testAddress)
+			c.mutex.Lock()
+			_, exists := c.allowedTransfers[key]
+			c.mutex.Unlock()
+			if exists || c.receives.busy(testAddress) || c.transferring(testAddress) {
+				t.Error("expected transfer of revoked peer to be canceled")
+			}
+			if !fakeOf(enc).removed[testAddress] {
+				t.Error("expected connection of revoked peer to be removed")
+			}
+		} else {
+			// even if the transfer is still allowed it must not be stored
+			enc.peers.mutex.Lock()
+			enc.peers.revoked[testAddress] = true
+			enc.peers.mutex.Unlock()
+		}
+		c.OnFileReceived(testAddress, path, key)
+		if _, err := enc.storage.Retrieve("object"); err == nil {
+			t.Errorf("revoke %v: object of revoked peer was stored", viaRevoke)
+		}
+	}
+}
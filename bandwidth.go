@@ -0,0 +1,132 @@
+package encrypted
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+bandwidth paces the start of uploads and downloads, both per peer and in total.
+It does NOT limit the rate of a running transfer: the channel moves each file on
+its own, so the only control is when a transfer may start. Every transfer
+reserves its size in the buckets, and the next transfer may only start once the
+reserved bytes would have been moved at the configured rate. A single large file
+therefore still moves at full speed; chunked transfers are paced per chunk,
+which keeps their average rate close to the configured one. Only sizes known to
+be true are reserved, so sizes advertised by peers are never trusted for this.
+*/
+type bandwidth struct {
+	mutex        sync.Mutex
+	upload       int64              // total upload pacing in bytes per second, zero for none
+	download     int64              // total download pacing in bytes per second, zero for none
+	peerUpload   int64              // upload pacing per peer in bytes per second, zero for none
+	peerDownload int64              // download pacing per peer in bytes per second, zero for none
+	uploads      bucket             // total uploads
+	downloads    bucket             // total downloads
+	peerUploads  map[string]*bucket // uploads per peer
+	peerDowns    map[string]*bucket // downloads per peer
+}
+
+/*
+bucket tracks when all bytes reserved so far will have been moved.
+*/
+type bucket struct {
+	next time.Time
+}
+
+/*
+createBandwidth returns a bandwidth without any limits.
+*/
+func createBandwidth() *bandwidth {
+	return &bandwidth{
+		peerUploads: make(map[string]*bucket),
+		peerDowns:   make(map[string]*bucket)}
+}
+
+/*
+SetTransferPacing sets the rates in bytes per second at which uploads and
+downloads are started, in total and per peer. Each transfer is only started
+once the previous ones would have finished at that rate; transfers that have
+started are not slowed down. Zero means no pacing. Can be changed at any time
+and applies to all transfers started afterwards.
+*/
+func (enc *Encrypted) SetTransferPacing(upload, download, peerUpload, peerDownload int64) {
+	b := enc.cInterface.bandwidth
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.upload = upload
+	b.download = download
+	b.peerUpload = peerUpload
+	b.peerDownload = peerDownload
+}
+
+/*
+delay reserves size bytes for a transfer with the given peer and returns how
+long the transfer must wait before it may start.
+*/
+func (b *bandwidth) delay(address string, upload bool, size int64) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	total, peer := b.download, b.peerDownload
+	totalBucket, peers := &b.downloads, b.peerDowns
+	if upload {
+		total, peer = b.upload, b.peerUpload
+		totalBucket, peers = &b.uploads, b.peerUploads
+	}
+	wait := totalBucket.reserve(total, size)
+	if peer > 0 {
+		peerBucket, exists := peers[address]
+		if !exists {
+			peerBucket = &bucket{}
+			peers[address] = peerBucket
+		}
+		if peerWait := peerBucket.reserve(peer, size); peerWait > wait {
+			wait = peerWait
+		}
+	}
+	return wait
+}
+
+/*
+reserve reserves size bytes at the given rate and returns how long to wait until
+the previously reserved bytes have been moved.
+*/
+func (bu *bucket) reserve(rate, size int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if bu.next.Before(now) {
+		bu.next = now
+	}
+	wait := bu.next.Sub(now)
+	if size > 0 {
+		bu.next = bu.next.Add(transferTime(size, rate))
+	}
+	return wait
+}
+
+/*
+transferTime returns how long moving size bytes takes at the given rate, capped
+at maxTransferTime.
+*/
+func transferTime(size, rate int64) time.Duration {
+	seconds := float64(size) / float64(rate)
+	if seconds >= maxTransferTime.Seconds() {
+		return maxTransferTime
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+/*
+throttle calls f once the pacing allows a transfer of size bytes with the given
+peer to start. If no waiting is required f is called directly.
+*/
+func (c *chaninterface) throttle(address string, upload bool, size int64, f func()) {
+	wait := c.bandwidth.delay(address, upload, size)
+	if wait <= 0 {
+		f()
+		return
+	}
+	time.AfterFunc(wait, f)
+}
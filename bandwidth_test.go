@@ -0,0 +1,52 @@
+package encrypted
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int64
+		sizes []int64       // sizes reserved one after the other
+		wait  time.Duration // expected wait of the last reservation
+	}{
+		{"no limit", 0, []int64{1000, 1000}, 0},
+		{"first is free", 100, []int64{1000}, 0},
+		{"waits for previous", 100, []int64{1000, 1}, 10 * time.Second},
+		{"adds up", 100, []int64{100, 200, 1}, 3 * time.Second},
+		{"negative size", 100, []int64{-1000, 1}, 0},
+		{"huge size is capped", 1, []int64{1 << 62, 1}, maxTransferTime},
+		{"large size doesn't overflow", 1 << 20, []int64{10 << 30, 1}, 10240 * time.Second},
+	}
+	for _, test := range tests {
+		bu := &bucket{}
+		var wait time.Duration
+		for _, size := range test.sizes {
+			wait = bu.reserve(test.rate, size)
+		}
+		// allow for the time passing while reserving
+		if wait > test.wait || wait < test.wait-time.Second {
+			t.Errorf("%s: expected wait of %v, got %v", test.name, test.wait, wait)
+		}
+	}
+}
+
+func TestBandwidthDelay(t *testing.T) {
+	b := createBandwidth()
+	b.download = 1000
+	b.peerDownload = 100
+	b.delay("a", false, 100)
+	// the peer bucket is the slower one for a, b only waits for the total
+	if wait := b.delay("a", false, 1); wait < 900*time.Millisecond {
+		t.Errorf("expected a to wait for its own limit, got %v", wait)
+	}
+	if wait := b.delay("b", false, 1); wait > 500*time.Millisecond {
+		t.Errorf("expected b to only wait for the total limit, got %v", wait)
+	}
+	// uploads are limited separately
+	if wait := b.delay("a", true, 1); wait != 0 {
+		t.Errorf("expected no upload limit, got %v", wait)
+	}
+}
@@ -2,7 +2,6 @@ package encrypted
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
 	"strings"
@@ -12,15 +11,70 @@ import (
 )
 
 type chaninterface struct {
-	enc              *Encrypted                    // reference back to encrypted
-	allowedTransfers map[string]shared.PushMessage // storage for allowed uploads to encrypted
-	mutex            sync.Mutex                    // required for map of incomming stuff
+	enc              *Encrypted             // reference back to encrypted
+	allowedTransfers map[string]pushMessage // storage for allowed uploads to encrypted
+	moving           map[string]bool        // keys of allowed uploads whose data is being received
+	mutex            sync.Mutex             // required for map of incomming stuff
+	chunkMutex       sync.Mutex             // serializes updates of partial chunked transfers
+	sends            *scheduler             // limits concurrent outgoing transfers
+	receives         *scheduler             // limits concurrent incoming transfers
+	bandwidth        *bandwidth             // paces the start of transfers
 }
 
 func createChanInterface(enc *Encrypted) *chaninterface {
 	return &chaninterface{
 		enc:              enc,
-		allowedTransfers: make(map[string]shared.PushMessage)}
+		allowedTransfers: make(map[string]pushMessage),
+		moving:           make(map[string]bool),
+		sends:            createScheduler(transfersPerPeer, transfersTotal),
+		receives:         createScheduler(transfersPerPeer, transfersTotal),
+		bandwidth:        createBandwidth()}
+}
+
+/*
+receiving returns whether a push of the given identification is allowed from
+any peer.
+*/
+func (c *chaninterface) receiving(identification string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, pm := range c.allowedTransfers {
+		if pm.Identification == identification {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+transferring returns whether data is being received from the address, that is
+a file of an allowed upload has been accepted and has neither been received nor
+canceled yet.
+*/
+func (c *chaninterface) transferring(address string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prefix := c.buildKey(address, "")
+	for key := range c.moving {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+setMoving marks whether data of the allowed upload with the given key is being
+received.
+*/
+func (c *chaninterface) setMoving(key string, moving bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if moving {
+		c.moving[key] = true
+		return
+	}
+	delete(c.moving, key)
 }
 
 // ----------------------- Callbacks ------------------------------
@@ -35,13 +89,18 @@ func (c *chaninterface) OnFriendRequest(address, message string) {
 }
 
 func (c *chaninterface) OnMessage(address, message string) {
+	// only trusted peers may do anything with encrypted
+	if !c.enc.isAuthorized(address) {
+		log.Println("OnMessage: message from unauthorized peer, ignoring!", address[:8])
+		return
+	}
 	// check if lock message, or request, or send message
 	v := &shared.Message{}
 	err := json.Unmarshal([]byte(message), v)
 	if err == nil {
 		// special case for lock messages (can be received if not locked)
 		if v.Type == shared.MsgLock {
-			msg := &shared.LockMessage{}
+			msg := &lockMessage{}
 			err := json.Unmarshal([]byte(message), msg)
 			if err != nil {
 				log.Println("OnMessage: failed to parse JSON!", err)
@@ -50,33 +109,45 @@ func (c *chaninterface) OnMessage(address, message string) {
 			c.handleLockMessage(address, msg)
 			return
 		}
-		// for all others ensure that we are locked correctly
-		if !c.enc.checkLock(address) {
-			// if not warn and ignore message
+		// for all others ensure that we are locked correctly, only requests are
+		// allowed with a shared lock
+		write := v.Type != shared.MsgRequest
+		if !c.enc.checkLock(address, write) {
+			// if not warn, notify them that they are unlocked, and ignore message
 			log.Println("OnMessage: not locked to given address!", address[:8])
-			// TODO send notify that they are unlocked back?
+			c.enc.sendLockStatus(address, statusUnlocked, grant{})
 			return
 		}
 		// if correctly locked handle message according to type
 		switch msgType := v.Type; msgType {
 		case shared.MsgRequest:
-			msg := &shared.RequestMessage{}
+			msg := &requestMessage{}
 			err := json.Unmarshal([]byte(message), msg)
 			if err != nil {
 				log.Println("OnMessage: failed to parse JSON!", err)
 				return
 			}
+			if !c.enc.permits(address, false, msg.ObjType) {
+				log.Println("OnMessage: request not permitted for", address[:8])
+				c.sendForbidden(address, msg.Identification, msg.ObjType)
+				return
+			}
 			c.handleRequestMessage(address, msg)
 		case shared.MsgPush:
-			msg := &shared.PushMessage{}
+			msg := &pushMessage{}
 			err := json.Unmarshal([]byte(message), msg)
 			if err != nil {
 				log.Println("OnMessage: failed to parse JSON!", err)
 				return
 			}
+			if !c.enc.permits(address, true, msg.ObjType) {
+				log.Println("OnMessage: push not permitted for", address[:8])
+				c.sendForbidden(address, msg.Identification, msg.ObjType)
+				return
+			}
 			c.handlePushMessage(address, msg)
 		case shared.MsgNotify:
-			msg := &shared.NotifyMessage{}
+			msg := &notifyMessage{}
 			err := json.Unmarshal([]byte(message), msg)
 			if err != nil {
 				log.Println("OnMessage: failed to parse JSON!", err)
@@ -119,21 +190,48 @@ OnAllowFile is called when a file is to be received. Name should be the
 file identification!
 */
 func (c *chaninterface) OnAllowFile(address, name string) (bool, string) {
-	if !c.enc.checkLock(address) {
+	if !c.enc.isAuthorized(address) {
+		log.Println("OnAllowFile: unauthorized peer, refusing!")
+		return false, ""
+	}
+	if !c.enc.checkLock(address, true) {
 		log.Println("OnAllowFile: not locked to given address, refusing!")
+		c.enc.sendLockStatus(address, statusUnlocked, grant{})
+		return false, ""
+	}
+	//check against allowed files and allow if ok, chunks belong to the push of their object
+	identification, chunk, isChunk := parseChunkName(name)
+	if !validIdentification(identification) {
+		log.Println("OnAllowFile: refusing file transfer due to invalid name!")
 		return false, ""
 	}
-	//check against allowed files and allow if ok
-	key := c.buildKey(address, name)
 	c.mutex.Lock()
-	_, exists := c.allowedTransfers[key]
+	pm, exists := c.allowedTransfers[c.buildKey(address, identification)]
 	c.mutex.Unlock()
-	if !exists {
+	if !exists || isChunk != pm.isChunked() || (isChunk && chunk >= len(pm.Chunks)) {
 		log.Println("OnAllowFile: refusing file transfer due to no allowance!")
 		return false, ""
 	}
+	// the role may have changed since the push was allowed
+	if !c.enc.permits(address, true, pm.ObjType) {
+		log.Println("OnAllowFile: refusing file transfer not permitted for peer!")
+		c.sendForbidden(address, pm.Identification, pm.ObjType)
+		return false, ""
+	}
+	// chunks starting beyond the maximum size are never accepted
+	if isChunk && !c.enc.quotas.fits(pm.ObjType, int64(chunk)*pm.ChunkSize+1) {
+		log.Println("OnAllowFile: refusing chunk beyond maximum size!")
+		return false, ""
+	}
 	//write to RECEIVINGDIR
-	return true, c.enc.RootPath + "/" + shared.RECEIVINGDIR + "/" + key
+	path, err := c.transferPath(shared.RECEIVINGDIR, address, name)
+	if err != nil {
+		log.Println("OnAllowFile: refusing file transfer due to invalid path!")
+		return false, ""
+	}
+	// data is moving now, which keeps the lock from expiring until it is done
+	c.setMoving(c.buildKey(address, identification), true)
+	return true, path
 }
 
 /*
@@ -141,17 +239,25 @@ OnFileReceived is called when a file has been successfully received.
 */
 func (c *chaninterface) OnFileReceived(address, path, name string) {
 	// NOTE: no lock check so that locks don't have to stay on for long file transfers
-	// no matter what, remove temp file
+	// chunks are collected until the object is complete
+	if key, chunk, isChunk := parseChunkName(name); isChunk {
+		c.onChunkReceived(address, path, key, chunk)
+		return
+	}
+	// no matter what, remove temp file (unless it was moved into place)
 	defer func() {
 		err := os.Remove(path)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			log.Println("OnFileReceived: failed to remove temp file:", err)
 		}
 		// remove from allowedTransfers
-		c.mutex.Lock()
-		delete(c.allowedTransfers, name)
-		c.mutex.Unlock()
+		c.removeAllowance(name)
 	}()
+	// peers revoked while transferring may not store anything
+	if !c.enc.isAuthorized(address) {
+		log.Println("OnFileReceived: peer is not authorized, discarding", name)
+		return
+	}
 	// fetch push message for file
 	c.mutex.Lock()
 	pm, exists := c.allowedTransfers[name]
@@ -160,41 +266,11 @@ func (c *chaninterface) OnFileReceived(address, path, name string) {
 		log.Println("OnFileReceived: no associated push message found!")
 		return
 	}
-	// read data
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Println("OnFileReceived: failed to read file:", err)
-		return
-	}
-	// depending on the object type write the file to different locations:
-	switch pm.ObjType {
-	case shared.OtModel:
-		// model is not written to storage but to disk directly
-		path := c.enc.RootPath + "/" + shared.IDMODEL
-		err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
-		// log.Println("DEBUG: wrote model.")
-	case shared.OtPeer:
-		// peers are written to disk too, but in correct dir with pm.Name
-		path := c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.PEERSDIR + "/" + pm.Identification
-		err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
-		// log.Println("DEBUG: wrote peer.")
-	case shared.OtAuth:
-		// auth is also special case
-		path := c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.AUTHJSON
-		err = ioutil.WriteFile(path, data, shared.FILEPERMISSIONMODE)
-		// log.Println("DEBUG: wrote auth.")
-	case shared.OtObject:
-		// write to storage
-		err = c.enc.storage.Store(pm.Identification, data)
-	default:
-		log.Println("OnFileReceived: unknown ObjType for received file!", pm.ObjType)
-		return
-	}
-	// this means something failed
-	if err != nil {
-		log.Println("OnFileReceived: writing file failed:", err)
-		return
+	// the advertised size is not trusted, so account for the received size now
+	if stat, err := os.Stat(path); err == nil {
+		c.bandwidth.delay(address, false, stat.Size())
 	}
+	c.storeReceived(address, path, &pm)
 }
 
 /*
@@ -203,11 +279,10 @@ OnFileCanceled is called when a file has failed to be successfully received.
 func (c *chaninterface) OnFileCanceled(address, path string) {
 	// note: no lock check so that locks don't have to stay on for long file transfers
 	log.Println("OnFileCanceled:", path)
-	// remove temp file if exists
+	// remove temp file if exists, the slot must be freed in any case
 	err := os.Remove(path)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		log.Println("OnFileCanceled: failed to remove temp file:", err)
-		return
 	}
 	// get name of file, aka key
 	list := strings.Split(path, "/")
@@ -216,10 +291,14 @@ func (c *chaninterface) OnFileCanceled(address, path string) {
 		i = 0
 	}
 	name := list[i]
+	// for chunks keep the allowance, the partial transfer can be resumed
+	if key, _, isChunk := parseChunkName(name); isChunk {
+		c.setMoving(key, false)
+		c.receives.done(key)
+		return
+	}
 	// remove from allowedTransfers
-	c.mutex.Lock()
-	delete(c.allowedTransfers, name)
-	c.mutex.Unlock()
+	c.removeAllowance(name)
 }
 
 /*
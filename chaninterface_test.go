@@ -0,0 +1,96 @@
+package encrypted
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestOnFileCanceledFreesSlot(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	pm := pushMessage{PushMessage: shared.CreatePushMessage("object", shared.OtObject)}
+	c.OnMessage(testAddress, pm.JSON())
+	key := c.buildKey(testAddress, "object")
+	if !c.receives.busy(testAddress) {
+		t.Fatal("expected receive to be started")
+	}
+	// canceled before any data was written, so there is no temp file to remove
+	c.OnFileCanceled(testAddress, filepath.Join(enc.RootPath, shared.RECEIVINGDIR, key))
+	if c.receives.busy(testAddress) {
+		t.Error("expected receive slot to be freed")
+	}
+	c.mutex.Lock()
+	_, exists := c.allowedTransfers[key]
+	c.mutex.Unlock()
+	if exists {
+		t.Error("expected allowance to be removed")
+	}
+}
+
+func TestChanInterfaceConcurrent(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	enc.SetLockTimeout(5 * time.Millisecond)
+	var addresses []string
+	for i := 0; i < 6; i++ {
+		address := fmt.Sprintf("%016d", i)
+		enc.peers.trusted[address] = true
+		addresses = append(addresses, address)
+	}
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(address string, seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for j := 0; j < 200; j++ {
+				identification := "object" + strconv.Itoa(random.Intn(3))
+				switch random.Intn(7) {
+				case 0:
+					lm := lockMessage{LockMessage: shared.CreateLockMessage(shared.LoRequest), Mode: modeOf(random.Intn(2) == 0)}
+					c.OnMessage(address, lm.JSON())
+				case 1:
+					lm := lockMessage{LockMessage: shared.CreateLockMessage(shared.LoRelease)}
+					c.OnMessage(address, lm.JSON())
+				case 2:
+					pm := pushMessage{PushMessage: shared.CreatePushMessage(identification, shared.OtObject)}
+					c.OnMessage(address, pm.JSON())
+				case 3:
+					rm := requestMessage{RequestMessage: shared.CreateRequestMessage(shared.OtObject, identification)}
+					c.OnMessage(address, rm.JSON())
+				case 4:
+					c.OnAllowFile(address, identification)
+				case 5:
+					c.OnFileCanceled(address, filepath.Join(enc.RootPath, shared.RECEIVINGDIR, c.buildKey(address, identification)))
+				case 6:
+					enc.expireLock()
+				}
+				checkLockInvariant(t, enc.lock)
+			}
+		}(address, int64(i))
+	}
+	wg.Wait()
+	// a fencing token is never granted to two peers
+	owners := make(map[uint64]string)
+	for _, address := range addresses {
+		for _, lm := range fakeOf(enc).lockReplies(address) {
+			if lm.Status != statusGranted {
+				continue
+			}
+			if owner, exists := owners[lm.Token]; exists && owner != address {
+				t.Errorf("token %d granted to %s and %s", lm.Token, owner, address)
+			}
+			owners[lm.Token] = address
+		}
+	}
+	if len(owners) == 0 {
+		t.Error("expected locks to be granted")
+	}
+}
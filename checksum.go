@@ -0,0 +1,152 @@
+package encrypted
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+checksumStore records the SHA-256 checksum of every object encrypted holds. Each
+checksum is written to its own file so that updates stay cheap.
+*/
+type checksumStore struct {
+	dir string // directory the checksums are written to
+}
+
+/*
+createChecksumStore returns a checksumStore writing to the given directory.
+*/
+func createChecksumStore(dir string) *checksumStore {
+	return &checksumStore{dir: dir}
+}
+
+/*
+set records the checksum for the given object.
+*/
+func (cs *checksumStore) set(objType shared.ObjectType, identification, sum string) error {
+	path, err := cs.path(objType, identification)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(cs.dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(sum))
+}
+
+/*
+get returns the recorded checksum for the given object. If none has been
+recorded an empty string is returned.
+*/
+func (cs *checksumStore) get(objType shared.ObjectType, identification string) (string, error) {
+	path, err := cs.path(objType, identification)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+/*
+remove deletes the recorded checksum for the given object, if any.
+*/
+func (cs *checksumStore) remove(objType shared.ObjectType, identification string) error {
+	path, err := cs.path(objType, identification)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+/*
+path returns the file the checksum of the given object is written to.
+*/
+func (cs *checksumStore) path(objType shared.ObjectType, identification string) (string, error) {
+	var prefix string
+	switch objType {
+	case shared.OtObject:
+		prefix = "object"
+	case shared.OtModel:
+		// only one model exists, so ignore identification
+		prefix = "model"
+		identification = shared.IDMODEL
+	case shared.OtPeer:
+		prefix = "peer"
+	case shared.OtAuth:
+		// only one auth file exists, so ignore identification
+		prefix = "auth"
+		identification = shared.AUTHJSON
+	default:
+		return "", shared.ErrIllegalParameters
+	}
+	if !validKey(identification) {
+		return "", ErrInvalidKey
+	}
+	return cs.dir + "/" + prefix + "." + identification, nil
+}
+
+/*
+hashingReader is a reader that computes the checksum of all data read through
+it.
+*/
+type hashingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+}
+
+/*
+createHashingReader wraps the given reader.
+*/
+func createHashingReader(reader io.Reader) *hashingReader {
+	return &hashingReader{
+		reader: reader,
+		hash:   sha256.New()}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.reader.Read(p)
+	hr.hash.Write(p[:n])
+	return n, err
+}
+
+/*
+Sum returns the hex encoded checksum of all data read so far.
+*/
+func (hr *hashingReader) Sum() string {
+	return hex.EncodeToString(hr.hash.Sum(nil))
+}
+
+/*
+fileChecksum returns the hex encoded checksum of the file at path.
+*/
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hr := createHashingReader(file)
+	_, err = io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		return "", err
+	}
+	return hr.Sum(), nil
+}
@@ -0,0 +1,353 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Chunked transfers allow large objects to be moved in numbered chunks. For
+pushes the peer announces the object with a pushMessage listing the checksum of
+every chunk; encrypted then requests the chunks one by one. Received chunks are
+written into a partial file in RECEIVINGDIR that is kept if the transfer is
+interrupted, so that a new push of the same object resumes at the first missing
+chunk. For downloads the peer requests each chunk with a requestMessage;
+encrypted announces every chunk with a pushMessage carrying its checksum before
+sending it. Chunk files are named with chunkName.
+*/
+
+/*
+partialState is the progress of a chunked push, stored next to the partial file.
+*/
+type partialState struct {
+	ChunkSize int64    `json:"chunksize"`
+	Chunks    []string `json:"chunks"`
+	Received  []bool   `json:"received"`
+}
+
+/*
+chunkName returns the file name used when transferring the given chunk.
+*/
+func chunkName(name string, chunk int) string {
+	return name + chunkSeparator + strconv.Itoa(chunk)
+}
+
+/*
+parseChunkName splits a name built by chunkName. Returns false if the name does
+not belong to a chunk.
+*/
+func parseChunkName(name string) (string, int, bool) {
+	index := strings.LastIndex(name, chunkSeparator)
+	if index < 0 {
+		return name, 0, false
+	}
+	chunk, err := strconv.Atoi(name[index+len(chunkSeparator):])
+	if err != nil || chunk < 0 {
+		return name, 0, false
+	}
+	return name[:index], chunk, true
+}
+
+/*
+isChunked returns whether the push announces a chunked transfer.
+*/
+func (pm *pushMessage) isChunked() bool {
+	return len(pm.Chunks) > 0
+}
+
+/*
+validChunks checks whether the chunk information of the push is consistent.
+*/
+func (pm *pushMessage) validChunks() bool {
+	if pm.ChunkSize <= 0 || pm.ChunkSize > maxChunkSize || pm.Size < 0 {
+		return false
+	}
+	// if a size is given it must match the number of chunks
+	count := int64(len(pm.Chunks))
+	if pm.Size > 0 && (pm.Size <= (count-1)*pm.ChunkSize || pm.Size > count*pm.ChunkSize) {
+		return false
+	}
+	return true
+}
+
+/*
+next returns the first chunk that has not been received yet, or -1 if all have
+been received.
+*/
+func (ps *partialState) next() int {
+	for chunk, received := range ps.Received {
+		if !received {
+			return chunk
+		}
+	}
+	return -1
+}
+
+/*
+matches returns whether the state belongs to the same object as the push.
+*/
+func (ps *partialState) matches(pm *pushMessage) bool {
+	if ps.ChunkSize != pm.ChunkSize || len(ps.Chunks) != len(pm.Chunks) || len(ps.Received) != len(ps.Chunks) {
+		return false
+	}
+	for i := range ps.Chunks {
+		if ps.Chunks[i] != pm.Chunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+startChunkedPush requests the first missing chunk of the pushed object. If a
+partial transfer of the same object exists it is resumed.
+*/
+func (c *chaninterface) startChunkedPush(address, key string, pm *pushMessage) {
+	c.chunkMutex.Lock()
+	state, err := c.loadPartial(key, pm)
+	c.chunkMutex.Unlock()
+	if err != nil {
+		log.Println("startChunkedPush: failed to prepare partial transfer:", err)
+		return
+	}
+	next := state.next()
+	if next > 0 {
+		log.Println("Resuming", pm.Identification, "at chunk", next)
+	}
+	// can happen if we crashed after the last chunk but before storing: request
+	// the last chunk again which completes the object once received
+	if next < 0 {
+		next = len(state.Chunks) - 1
+	}
+	c.requestChunk(address, pm, next)
+}
+
+/*
+onChunkReceived handles a single received chunk. The chunk is verified and
+written into the partial file. Once all chunks are there the object is stored,
+otherwise the next missing chunk is requested.
+*/
+func (c *chaninterface) onChunkReceived(address, path, key string, chunk int) {
+	// chunk files are always removed, the partial file holds the data
+	defer func() {
+		err := os.Remove(path)
+		if err != nil {
+			log.Println("onChunkReceived: failed to remove temp file:", err)
+		}
+	}()
+	// peers revoked while transferring may not store anything
+	if !c.enc.isAuthorized(address) {
+		log.Println("onChunkReceived: peer is not authorized, discarding chunk of", key)
+		c.removeAllowance(key)
+		return
+	}
+	c.mutex.Lock()
+	// the chunk is done, until the next one is allowed no data is moving
+	delete(c.moving, key)
+	pm, exists := c.allowedTransfers[key]
+	c.mutex.Unlock()
+	if !exists || !pm.isChunked() || chunk >= len(pm.Chunks) {
+		log.Println("onChunkReceived: no associated chunked push found!")
+		return
+	}
+	// verify the chunk
+	sum, err := fileChecksum(path)
+	if err != nil {
+		log.Println("onChunkReceived: failed to compute checksum:", err)
+		return
+	}
+	if sum != pm.Chunks[chunk] {
+		log.Println("onChunkReceived: checksum mismatch of chunk", chunk, "of", pm.Identification+", requesting again")
+		c.requestChunk(address, &pm, chunk)
+		return
+	}
+	// abort as soon as the received data exceeds the maximum size
+	stat, err := os.Stat(path)
+	if err != nil {
+		log.Println("onChunkReceived: failed to stat chunk:", err)
+		return
+	}
+	if !c.enc.quotas.fits(pm.ObjType, int64(chunk)*pm.ChunkSize+stat.Size()) {
+		log.Println("onChunkReceived: object too large, aborting", pm.Identification)
+		c.refusePush(address, &pm, reasonTooLarge)
+		c.chunkMutex.Lock()
+		c.removePartial(key)
+		c.chunkMutex.Unlock()
+		c.removeAllowance(key)
+		return
+	}
+	c.chunkMutex.Lock()
+	state, err := c.loadPartial(key, &pm)
+	if err == nil {
+		err = c.writeChunk(key, path, chunk, &pm)
+	}
+	if err == nil {
+		state.Received[chunk] = true
+		err = c.storePartial(key, state)
+	}
+	c.chunkMutex.Unlock()
+	if err != nil {
+		log.Println("onChunkReceived: failed to write chunk:", err)
+		return
+	}
+	// request next chunk if any are missing
+	if next := state.next(); next >= 0 {
+		c.requestChunk(address, &pm, next)
+		return
+	}
+	// all chunks there, so store the object and clean up
+	c.storeReceived(address, c.partialPath(key), &pm)
+	c.removePartial(key)
+	c.removeAllowance(key)
+}
+
+/*
+requestChunk requests the given chunk of a chunked push once pacing allows
+it.
+*/
+func (c *chaninterface) requestChunk(address string, pm *pushMessage, chunk int) {
+	rm := createChunkRequest(pm.ObjType, pm.Identification, chunk, pm.ChunkSize)
+	rm.MaxSize = c.enc.quotas.maxSize(pm.ObjType)
+	c.throttle(address, false, pm.ChunkSize, func() {
+		c.enc.channel.Send(address, rm.JSON())
+	})
+}
+
+/*
+writeChunk writes the chunk at path into the partial file of key.
+*/
+func (c *chaninterface) writeChunk(key, path string, chunk int, pm *pushMessage) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// all chunks but the last must be exactly ChunkSize
+	if stat.Size() > pm.ChunkSize || (chunk < len(pm.Chunks)-1 && stat.Size() != pm.ChunkSize) {
+		return errInvalidChunk
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(c.partialPath(key), os.O_WRONLY|os.O_CREATE, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	_, err = out.Seek(int64(chunk)*pm.ChunkSize, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+/*
+loadPartial returns the progress of the partial transfer of key. If none exists
+or it belongs to a different object a new one is started. NOTE: chunkMutex must
+be held when calling this.
+*/
+func (c *chaninterface) loadPartial(key string, pm *pushMessage) (*partialState, error) {
+	state := &partialState{}
+	data, err := ioutil.ReadFile(c.partialPath(key) + partialStateSuffix)
+	if err == nil && json.Unmarshal(data, state) == nil && state.matches(pm) {
+		return state, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// start over
+	c.removePartial(key)
+	state = &partialState{
+		ChunkSize: pm.ChunkSize,
+		Chunks:    pm.Chunks,
+		Received:  make([]bool, len(pm.Chunks))}
+	return state, c.storePartial(key, state)
+}
+
+/*
+storePartial writes the progress of the partial transfer of key.
+*/
+func (c *chaninterface) storePartial(key string, state *partialState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.partialPath(key)+partialStateSuffix, data)
+}
+
+/*
+removePartial removes the partial file and progress of key.
+*/
+func (c *chaninterface) removePartial(key string) {
+	path := c.partialPath(key)
+	os.Remove(path)
+	os.Remove(path + partialStateSuffix)
+}
+
+/*
+partialPath returns the path of the partial file of key.
+*/
+func (c *chaninterface) partialPath(key string) string {
+	return c.enc.RootPath + "/" + shared.RECEIVINGDIR + "/" + key + partialSuffix
+}
+
+/*
+sendChunk sends the requested chunk of the data read from reader. The chunk is
+announced with a pushMessage carrying its checksum before it is sent.
+*/
+func (c *chaninterface) sendChunk(address, key string, rm *requestMessage, identification string, reader io.Reader) bool {
+	offset := int64(rm.Chunk) * rm.ChunkSize
+	// skip to the chunk
+	var err error
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, reader, offset)
+	}
+	if err != nil && err != io.EOF {
+		log.Println("sendChunk: failed to skip to chunk:", err)
+		return false
+	}
+	name := chunkName(rm.Identification, rm.Chunk)
+	filePath, err := c.transferPath(shared.SENDINGDIR, address, chunkName(identification, rm.Chunk))
+	if err != nil {
+		log.Println("sendChunk: invalid temp file:", err)
+		return false
+	}
+	hr := createHashingReader(io.LimitReader(reader, rm.ChunkSize))
+	err = writeStream(filePath, hr)
+	if err != nil {
+		log.Println("sendChunk: failed to write data to SEDIR:", err)
+		return false
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil || (stat.Size() == 0 && rm.Chunk > 0) {
+		// chunk is beyond the end of the object
+		os.Remove(filePath)
+		nm := shared.CreateNotifyMessage(shared.NoMissing, name, rm.ObjType)
+		c.enc.channel.Send(address, nm.JSON())
+		return false
+	}
+	// announce chunk
+	pm := &pushMessage{
+		PushMessage: shared.CreatePushMessage(name, rm.ObjType),
+		Checksum:    hr.Sum(),
+		Size:        stat.Size(),
+		ChunkSize:   rm.ChunkSize}
+	c.enc.channel.Send(address, pm.JSON())
+	return c.sendFile(address, key, filePath, name, true)
+}
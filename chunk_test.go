@@ -0,0 +1,142 @@
+package encrypted
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestParseChunkName(t *testing.T) {
+	tests := []struct {
+		name           string
+		identification string
+		chunk          int
+		isChunk        bool
+	}{
+		{chunkName("id", 0), "id", 0, true},
+		{chunkName("id", 12), "id", 12, true},
+		{"id", "id", 0, false},
+		{"id#", "id#", 0, false},
+		{"id#x", "id#x", 0, false},
+		{"id#-1", "id#-1", 0, false},
+		{"a#b#3", "a#b", 3, true},
+	}
+	for _, test := range tests {
+		identification, chunk, isChunk := parseChunkName(test.name)
+		if identification != test.identification || chunk != test.chunk || isChunk != test.isChunk {
+			t.Errorf("parseChunkName(%q) = %q, %d, %v; expected %q, %d, %v", test.name,
+				identification, chunk, isChunk, test.identification, test.chunk, test.isChunk)
+		}
+	}
+}
+
+func TestValidChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64
+		chunkSize int64
+		chunks    int
+		valid     bool
+	}{
+		{"without size", 0, 10, 3, true},
+		{"exact size", 30, 10, 3, true},
+		{"partial last chunk", 21, 10, 3, true},
+		{"size too small", 20, 10, 3, false},
+		{"size too large", 31, 10, 3, false},
+		{"zero chunk size", 0, 0, 3, false},
+		{"negative chunk size", 0, -10, 3, false},
+	}
+	for _, test := range tests {
+		pm := &pushMessage{
+			PushMessage: shared.CreatePushMessage("id", shared.OtObject),
+			Size:        test.size,
+			ChunkSize:   test.chunkSize,
+			Chunks:      make([]string, test.chunks)}
+		if valid := pm.validChunks(); valid != test.valid {
+			t.Errorf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+func TestChunkedPushResume(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	chunks := []string{"aaaa", "bbbb", "cc"}
+	pm := pushMessage{
+		PushMessage: shared.CreatePushMessage("object", shared.OtObject),
+		Size:        10,
+		ChunkSize:   4}
+	for _, chunk := range chunks {
+		sum := sha256.Sum256([]byte(chunk))
+		pm.Chunks = append(pm.Chunks, hex.EncodeToString(sum[:]))
+	}
+	// the first chunk was received before the transfer was interrupted
+	key := c.buildKey(testAddress, "object")
+	if err := ioutil.WriteFile(c.partialPath(key), []byte(chunks[0]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state := partialState{ChunkSize: pm.ChunkSize, Chunks: pm.Chunks, Received: []bool{true, false, false}}
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.partialPath(key)+partialStateSuffix, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.OnMessage(testAddress, pm.JSON())
+	// the new push resumes at the first missing chunk
+	for chunk := 1; chunk < len(chunks); chunk++ {
+		requests := fakeOf(enc).requests(testAddress)
+		if len(requests) != chunk || requests[chunk-1].Chunk != chunk {
+			t.Fatalf("expected request of chunk %d, got %v", chunk, requests)
+		}
+		name := chunkName("object", chunk)
+		allowed, path := c.OnAllowFile(testAddress, name)
+		if !allowed {
+			t.Fatalf("expected chunk %d to be allowed", chunk)
+		}
+		if err := ioutil.WriteFile(path, []byte(chunks[chunk]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c.OnFileReceived(testAddress, path, chunkName(key, chunk))
+	}
+	stored, err := enc.storage.Retrieve("object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "aaaabbbbcc" {
+		t.Errorf("expected resumed object to be stored, got %q", stored)
+	}
+	if _, err := ioutil.ReadFile(c.partialPath(key) + partialStateSuffix); err == nil {
+		t.Error("expected partial transfer to be removed")
+	}
+}
+
+func TestChunkedPushRestartsOtherObject(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	sum := sha256.Sum256([]byte("aaaa"))
+	pm := pushMessage{
+		PushMessage: shared.CreatePushMessage("object", shared.OtObject),
+		ChunkSize:   4,
+		Chunks:      []string{hex.EncodeToString(sum[:]), hex.EncodeToString(sum[:])}}
+	// progress of a different version of the object is not resumed
+	key := c.buildKey(testAddress, "object")
+	state := partialState{ChunkSize: 4, Chunks: []string{"other", "other"}, Received: []bool{true, false}}
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.partialPath(key)+partialStateSuffix, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.OnMessage(testAddress, pm.JSON())
+	requests := fakeOf(enc).requests(testAddress)
+	if len(requests) != 1 || requests[0].Chunk != 0 {
+		t.Errorf("expected request of first chunk, got %v", requests)
+	}
+}
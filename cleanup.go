@@ -0,0 +1,82 @@
+package encrypted
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+CleanTemporary removes stale files from SENDINGDIR and RECEIVINGDIR. Files left
+over from failed sends are kept for debugging until they are older than the
+given retention. Partial chunked pushes are kept for resuming until they are
+older than the retention, all other received files are removed as their
+transfer can't continue. Returns the number of removed files. Called on Load
+with the default retention.
+*/
+func (enc *Encrypted) CleanTemporary(retention time.Duration) (int, error) {
+	var removed, recovered int
+	// sending: only failed sends remain, keep them for retention
+	sending := enc.RootPath + "/" + shared.SENDINGDIR
+	stats, err := ioutil.ReadDir(sending)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, stat := range stats {
+		if time.Since(stat.ModTime()) < retention {
+			continue
+		}
+		if enc.removeTemporary(sending + "/" + stat.Name()) {
+			removed++
+		}
+	}
+	// receiving: only partial chunked pushes can be resumed
+	receiving := enc.RootPath + "/" + shared.RECEIVINGDIR
+	stats, err = ioutil.ReadDir(receiving)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, stat := range stats {
+		name := stat.Name()
+		partial := strings.HasSuffix(name, partialSuffix) || strings.HasSuffix(name, partialSuffix+partialStateSuffix)
+		if partial && time.Since(stat.ModTime()) < retention {
+			recovered++
+			continue
+		}
+		if enc.removeTemporary(receiving + "/" + name) {
+			removed++
+		}
+	}
+	enc.cleanMutex.Lock()
+	enc.cleaned += removed
+	enc.cleanMutex.Unlock()
+	enc.log("Cleaned", strconv.Itoa(removed), "temporary files, kept", strconv.Itoa(recovered), "partial transfer files.")
+	return removed, nil
+}
+
+/*
+Cleaned returns the total number of stale temporary files removed by
+CleanTemporary since this Encrypted was loaded.
+*/
+func (enc *Encrypted) Cleaned() int {
+	enc.cleanMutex.Lock()
+	defer enc.cleanMutex.Unlock()
+	return enc.cleaned
+}
+
+/*
+removeTemporary removes the given file or directory, logging failures. Returns
+whether it was removed.
+*/
+func (enc *Encrypted) removeTemporary(path string) bool {
+	err := os.RemoveAll(path)
+	if err != nil {
+		enc.warn("Failed to remove temporary file:", err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package encrypted
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestCleanTemporary(t *testing.T) {
+	enc := createTestEncrypted(t)
+	tests := []struct {
+		dir  string
+		name string
+		age  time.Duration
+		kept bool
+	}{
+		{shared.SENDINGDIR, "failed", 2 * time.Hour, false},
+		{shared.SENDINGDIR, "recent", 0, true},
+		{shared.RECEIVINGDIR, "key" + partialSuffix, 0, true},
+		{shared.RECEIVINGDIR, "key" + partialSuffix + partialStateSuffix, 0, true},
+		{shared.RECEIVINGDIR, "old" + partialSuffix, 2 * time.Hour, false},
+		{shared.RECEIVINGDIR, "old" + partialSuffix + partialStateSuffix, 2 * time.Hour, false},
+		{shared.RECEIVINGDIR, "received", 0, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(enc.RootPath, test.dir, test.name)
+		if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-test.age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := enc.CleanTemporary(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 || enc.Cleaned() != 4 {
+		t.Errorf("expected 4 removed files, got %d, total %d", removed, enc.Cleaned())
+	}
+	for _, test := range tests {
+		_, err := os.Stat(filepath.Join(enc.RootPath, test.dir, test.name))
+		if kept := err == nil; kept != test.kept {
+			t.Errorf("%s/%s: expected kept to be %v", test.dir, test.name, test.kept)
+		}
+	}
+}
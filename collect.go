@@ -0,0 +1,115 @@
+package encrypted
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+CollectOptions control the behaviour of a garbage collection run.
+*/
+type CollectOptions struct {
+	DryRun     bool          // if true nothing is removed, only reported
+	Quarantine bool          // if true orphans are moved to quarantine instead of being removed
+	MinAge     time.Duration // orphans modified more recently than this are kept, zero means the lock timeout
+}
+
+/*
+CollectReport is the result of a garbage collection run.
+*/
+type CollectReport struct {
+	Checked   int       // number of keys checked
+	Orphans   []KeyInfo // keys that are not part of the live set
+	Collected int       // number of orphans actually removed or quarantined
+	Bytes     int64     // bytes freed by the collected orphans
+}
+
+/*
+CollectGarbage removes all objects from storage that are not contained in the
+given set of live object IDs. As the model is encrypted Encrypted can not derive
+the live set itself, so it must be supplied by a trusted peer or the operator.
+As a sync may push objects that are not part of the live set yet, collection is
+refused with ErrLocked while the exclusive lock is held. Requires the storage to
+implement Lister.
+*/
+func (enc *Encrypted) CollectGarbage(live map[string]bool, options CollectOptions) (*CollectReport, error) {
+	if live == nil {
+		return nil, shared.ErrIllegalParameters
+	}
+	if enc.lock.writeLocked() {
+		return nil, ErrLocked
+	}
+	minAge := options.MinAge
+	if minAge <= 0 {
+		minAge = enc.lock.currentTimeout()
+	}
+	report := &CollectReport{}
+	now := time.Now()
+	// first find all orphans so that we don't modify storage while listing it
+	err := enc.walkStorage(func(info KeyInfo) error {
+		report.Checked++
+		if live[info.Key] {
+			return nil
+		}
+		// keep recent objects, they may belong to a sync that is in progress
+		if now.Sub(info.ModTime) < minAge {
+			return nil
+		}
+		report.Orphans = append(report.Orphans, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if options.DryRun {
+		return report, nil
+	}
+	for _, info := range report.Orphans {
+		// stop if a sync has started in the meantime
+		if enc.lock.writeLocked() {
+			return report, ErrLocked
+		}
+		if options.Quarantine {
+			err = enc.quarantine(info.Key)
+		} else {
+			err = enc.removeObject(info.Key)
+		}
+		if err != nil {
+			log.Println("CollectGarbage: failed to collect", info.Key+":", err)
+			continue
+		}
+		report.Collected++
+		report.Bytes += info.Size
+	}
+	enc.log("Garbage collection removed", strconv.Itoa(report.Collected), "of", strconv.Itoa(report.Checked), "objects.")
+	return report, nil
+}
+
+/*
+quarantine moves the data of the given key from storage to the quarantine
+directory in LOCALDIR.
+*/
+func (enc *Encrypted) quarantine(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	dir := enc.RootPath + "/" + shared.LOCALDIR + "/" + quarantineDir
+	err := os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	reader, err := enc.retrieveObject(key)
+	if err != nil {
+		return err
+	}
+	err = writeStream(dir+"/"+key, reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	return enc.removeObject(key)
+}
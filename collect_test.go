@@ -0,0 +1,94 @@
+package encrypted
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+storeAged stores data under key in the storage of enc and backdates it by age.
+*/
+func storeAged(t *testing.T, enc *Encrypted, key string, age time.Duration) {
+	if err := enc.storage.Store(key, []byte(key)); err != nil {
+		t.Fatal(err)
+	}
+	path, err := enc.locateObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	enc := createTestEncrypted(t)
+	live := map[string]bool{"live": true}
+	storeAged(t, enc, "live", time.Hour)
+	storeAged(t, enc, "orphan", time.Hour)
+	storeAged(t, enc, "recent", 0)
+	// no collection while a sync holds the exclusive lock
+	if _, err := enc.CollectGarbage(live, CollectOptions{}); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	enc.releaseLock(testAddress)
+	// a dry run only reports
+	report, err := enc.CollectGarbage(live, CollectOptions{DryRun: true, MinAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || len(report.Orphans) != 1 || report.Orphans[0].Key != "orphan" || report.Collected != 0 {
+		t.Errorf("unexpected dry run report: %+v", report)
+	}
+	if _, err := enc.storage.Retrieve("orphan"); err != nil {
+		t.Error("dry run removed orphan:", err)
+	}
+	// quarantined orphans are moved out of storage but kept
+	report, err = enc.CollectGarbage(live, CollectOptions{Quarantine: true, MinAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Collected != 1 || report.Bytes != int64(len("orphan")) {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if _, err := enc.storage.Retrieve("orphan"); err == nil {
+		t.Error("expected orphan to be removed from storage")
+	}
+	data, err := ioutil.ReadFile(enc.RootPath + "/" + shared.LOCALDIR + "/" + quarantineDir + "/orphan")
+	if err != nil || string(data) != "orphan" {
+		t.Errorf("expected orphan in quarantine, got %q, %v", data, err)
+	}
+	for _, key := range []string{"live", "recent"} {
+		if _, err := enc.storage.Retrieve(key); err != nil {
+			t.Errorf("expected %s to be kept: %v", key, err)
+		}
+	}
+}
+
+func TestCollectGarbageMinAge(t *testing.T) {
+	enc := createTestEncrypted(t)
+	enc.releaseLock(testAddress)
+	storeAged(t, enc, "orphan", time.Minute)
+	// without a minimum age orphans younger than the lock timeout are kept
+	enc.SetLockTimeout(time.Hour)
+	report, err := enc.CollectGarbage(map[string]bool{}, CollectOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Errorf("expected recent orphan to be kept, got %v", report.Orphans)
+	}
+	enc.SetLockTimeout(time.Second)
+	report, err = enc.CollectGarbage(map[string]bool{}, CollectOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 {
+		t.Errorf("expected orphan older than the lock timeout, got %v", report.Orphans)
+	}
+}
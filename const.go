@@ -5,12 +5,185 @@ import (
 	"time"
 )
 
-/*lockTimeout if how long a lock is kept if no new messages are received.*/
+/*
+lockTimeout is the default for how long a lock is kept if no new messages are
+received.
+*/
 const lockTimeout = time.Duration(1 * time.Minute)
 
+/*
+lockCheckInterval is how often the background process checks for timed out
+locks.
+*/
+const lockCheckInterval = time.Duration(5 * time.Second)
+
+/*
+persistDelay is how long changes to the lock state are collected before they
+are written to disk.
+*/
+const persistDelay = time.Duration(1 * time.Second)
+
+/*
+lockStateJSON is the file within LOCALDIR the lock state is persisted to.
+*/
+const lockStateJSON = "lock.json"
+
+/*
+chunkSeparator separates the identification from the chunk number in the names
+of transferred chunks.
+*/
+const chunkSeparator = "#"
+
+/*
+partialSuffix is appended to the transfer key for the partial file of a chunked
+push in RECEIVINGDIR, partialStateSuffix for the file holding its progress.
+*/
+const (
+	partialSuffix      = ".part"
+	partialStateSuffix = ".json"
+)
+
+/*
+tempRetention is the default for how long stale temporary files are kept.
+*/
+const tempRetention = time.Duration(24 * time.Hour)
+
+/*
+maxTransferTime is the longest a single transfer may delay the start of others
+when pacing transfers.
+*/
+const maxTransferTime = time.Duration(24 * time.Hour)
+
+/*
+maxChunkSize is the largest chunk size accepted for chunked pushes, as chunks
+are reserved in the transfer pacing before they are received.
+*/
+const maxChunkSize = 64 * 1024 * 1024
+
+/*
+transfersPerPeer and transfersTotal are the default limits for concurrent sends
+and receives.
+*/
+const (
+	transfersPerPeer = 4
+	transfersTotal   = 16
+)
+
+/*
+maxIdentificationLength is the maximum length of identifications accepted from
+peers, chosen so that transfer keys built from them remain valid file names.
+*/
+const maxIdentificationLength = 160
+
+/*listPageSize is the number of keys fetched per call when listing the storage.*/
+const listPageSize = 1000
+
+/*
+quarantineDir is the directory within LOCALDIR where quarantined objects are
+moved to.
+*/
+const quarantineDir = "quarantine"
+
+/*
+checksumDir is the directory within LOCALDIR where the checksums of all stored
+objects are kept.
+*/
+const checksumDir = "checksums"
+
+/*
+permissionsJSON is the file within ORGDIR assigning roles to peers.
+*/
+const permissionsJSON = "permissions.json"
+
+/*
+signersJSON is the file within ORGDIR holding the keys allowed to sign changes
+to the auth and peer files.
+*/
+const signersJSON = "signers.json"
+
+/*
+versionsJSON is the file within LOCALDIR recording the version of the last
+accepted signed change to every auth and peer file.
+*/
+const versionsJSON = "versions.json"
+
+/*
+revokedJSON is the file within LOCALDIR listing the revoked peers.
+*/
+const revokedJSON = "revoked.json"
+
+/*
+quotaJSON is the file within LOCALDIR the storage usage is persisted to,
+ownerDir the directory within LOCALDIR recording who pushed each object.
+*/
+const (
+	quotaJSON = "quota.json"
+	ownerDir  = "owners"
+)
+
+/*
+scrubInterval is the default time between two scrub runs.
+*/
+const scrubInterval = time.Duration(24 * time.Hour)
+
+/*
+scrubRate is the default number of bytes per second read while scrubbing.
+*/
+const scrubRate = 4 * 1024 * 1024
+
 /*
 Various errors for encrypted.
 */
 var (
-	ErrNonEmpty = errors.New("non empty directory as path")
+	ErrNonEmpty   = errors.New("non empty directory as path")
+	ErrInvalidKey = errors.New("invalid storage key")
+	ErrNoLister   = errors.New("storage does not support listing")
+	ErrCorrupted  = errors.New("stored data failed checksum verification")
+	ErrLocked     = errors.New("encrypted is locked for writing")
+)
+
+/*
+errScrubAborted is used internally to stop a scrub run.
+*/
+var errScrubAborted = errors.New("scrub aborted")
+
+/*
+errInvalidIdentification is returned when an identification can't be used as a
+file name.
+*/
+var errInvalidIdentification = errors.New("invalid identification")
+
+/*
+errInvalidSignature is returned when a change to a control file is not signed
+correctly.
+*/
+var errInvalidSignature = errors.New("invalid signature")
+
+/*
+errUnknownType is returned for objects of an unknown type.
+*/
+var errUnknownType = errors.New("unknown object type")
+
+/*
+errNoSigners is returned when a change to a control file can't be verified as
+no signer is registered and unsigned changes are not allowed. errReplayed is
+returned when a signed change is not newer than the last accepted one.
+*/
+var (
+	errNoSigners = errors.New("no signers registered")
+	errReplayed  = errors.New("signed change is not newer than the current one")
 )
+
+/*
+errQuotaExceeded is returned when storing an object would exceed a quota,
+errReserved when the same object is already being stored.
+*/
+var (
+	errQuotaExceeded = errors.New("quota exceeded")
+	errReserved      = errors.New("object is already being stored")
+)
+
+/*
+errInvalidChunk is returned when a received chunk has the wrong size.
+*/
+var errInvalidChunk = errors.New("invalid chunk size")
@@ -1,7 +1,8 @@
 package encrypted
 
 import (
-	"encoding/json"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"log"
 	"strings"
@@ -16,16 +17,40 @@ import (
 Encrypted is the object which is used to control the encrypted Tinzenite peer.
 */
 type Encrypted struct {
-	RootPath      string
-	Peer          *shared.Peer
-	storage       Storage    // storage to use for writing and reading data
-	isLocked      bool       // is Encrypted currently locked?
-	lockedSince   *time.Time // time since Encrypted is locked.
-	lockedAddress string     // the address locked to
-	cInterface    *chaninterface
-	channel       *channel.Channel
-	wg            sync.WaitGroup
-	stop          chan bool
+	RootPath       string
+	Peer           *shared.Peer
+	storage        Storage        // storage to use for writing and reading data
+	checksums      *checksumStore // checksums of all stored data
+	quotas         *quotas        // usage and limits of the storage
+	peers          *peerList      // trusted peers allowed to access encrypted
+	scrubber       *scrubber      // background verification of stored data
+	lock           *locker        // lock state
+	stateMutex     sync.Mutex     // serializes writing the lock state to disk
+	persistMutex   sync.Mutex     // protects persistPending
+	persistPending bool           // whether a write of the lock state is scheduled
+	cleaned        int            // number of stale temporary files removed
+	cleanMutex     sync.Mutex     // protects cleaned
+	signMutex      sync.Mutex     // serializes verifying signed changes, protects allowUnsigned
+	allowUnsigned  bool           // whether unsigned changes are accepted while no signer is registered
+	cInterface     *chaninterface
+	channel        peerChannel
+	wg             sync.WaitGroup
+	stop           chan bool
+}
+
+/*
+peerChannel is the part of the channel Encrypted uses to talk to other peers.
+It is implemented by *channel.Channel and replaced by a fake in tests.
+*/
+type peerChannel interface {
+	Send(address, message string) error
+	SendFile(address, path, identification string, f func(channel.State)) error
+	AcceptConnection(address string) error
+	RemoveConnection(address string) error
+	Address() (string, error)
+	ConnectionAddress() (string, error)
+	ToxData() ([]byte, error)
+	Close()
 }
 
 /*
@@ -64,49 +89,37 @@ func (enc *Encrypted) Store() error {
 }
 
 /*
-IsLocked returns whether this Encrypted is currently locked to a peer. NOTE:
-does NOT update the time. That can only be done internally upon receiving valid
-messages.
+Usage returns the number of keys and the total size in bytes held by the
+storage. Requires the storage to implement Lister.
 */
-func (enc *Encrypted) IsLocked() bool {
-	// if a time is set and enc is locked, check timeout
-	if enc.lockedSince != nil && enc.isLocked && time.Since(*enc.lockedSince) < lockTimeout {
-		// if time beneath limit still locked
-		return true
+func (enc *Encrypted) Usage() (int, int64, error) {
+	var count int
+	var size int64
+	err := enc.walkStorage(func(info KeyInfo) error {
+		count++
+		size += info.Size
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
 	}
-	// otherwise: reset and return false
-	enc.ClearLock()
-	return false
+	return count, size, nil
 }
 
 /*
-ClearLock can be used to clear an existing lock. Internally called when a lock is
-released. NOTE: this method is public to allow forcing a lock clear.
+Keys returns all keys currently held by the storage. Requires the storage to
+implement Lister.
 */
-func (enc *Encrypted) ClearLock() {
-	// note address we are clearing
-	address := enc.lockedAddress
-	// clean lock
-	enc.isLocked = false
-	enc.lockedAddress = ""
-	enc.lockedSince = nil
-	// if not valid address we didn't really clear a lock, so we're done
-	if address == "" {
-		return
-	}
-	log.Println("Encrypted: released from", address[:8])
-	//clean up any outstanding file transfers for cleared address (but not running ones!)
-	var toRemove []string
-	enc.cInterface.mutex.Lock()
-	for key := range enc.cInterface.allowedTransfers {
-		if strings.HasPrefix(key, address) {
-			toRemove = append(toRemove, key)
-		}
-	}
-	for _, key := range toRemove {
-		delete(enc.cInterface.allowedTransfers, key)
+func (enc *Encrypted) Keys() ([]KeyInfo, error) {
+	var keys []KeyInfo
+	err := enc.walkStorage(func(info KeyInfo) error {
+		keys = append(keys, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	enc.cInterface.mutex.Unlock()
+	return keys, nil
 }
 
 /*
@@ -116,51 +129,108 @@ func (enc *Encrypted) Close() {
 	enc.stop <- true
 	enc.wg.Wait()
 	enc.channel.Close()
+	// write any pending changes of the lock state
+	enc.flushLock()
+}
+
+/*
+walkStorage calls f for every key in storage, fetching them page by page. If f
+returns an error the walk is aborted and the error returned.
+*/
+func (enc *Encrypted) walkStorage(f func(KeyInfo) error) error {
+	lister, ok := enc.storage.(Lister)
+	if !ok {
+		return ErrNoLister
+	}
+	var after string
+	for {
+		page, err := lister.List(after, listPageSize)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		for _, info := range page {
+			err = f(info)
+			if err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].Key
+	}
+}
+
+/*
+storeObject writes all data read from the reader to the given key in storage.
+If the storage supports streaming the data is never held in memory completely.
+*/
+func (enc *Encrypted) storeObject(key string, reader io.Reader) error {
+	if streamer, ok := enc.storage.(Streamer); ok {
+		return streamer.StoreStream(key, reader)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return enc.storage.Store(key, data)
+}
+
+/*
+retrieveObject opens the data of the given key in storage for reading. The
+caller must close the returned reader.
+*/
+func (enc *Encrypted) retrieveObject(key string) (io.ReadCloser, error) {
+	if streamer, ok := enc.storage.(Streamer); ok {
+		return streamer.RetrieveStream(key)
+	}
+	data, err := enc.storage.Retrieve(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
 /*
-setLock can set the lock. The return value signifies whether the lock was
-successful. If not, it most likely means that Encrypted is already locked.
+locateObject returns the path of the file holding the data of the given key if
+the storage supports it, otherwise an empty string.
 */
-func (enc *Encrypted) setLock(address string) bool {
-	// if still validly locked and address mismatches we can't lock
-	if enc.IsLocked() && enc.lockedAddress != address {
-		return false
+func (enc *Encrypted) locateObject(key string) (string, error) {
+	if locator, ok := enc.storage.(Locator); ok {
+		return locator.Locate(key)
 	}
-	log.Println("Encrypted: locked to", address[:8])
-	timeStamp := time.Now()
-	// otherwise set lock
-	enc.isLocked = true
-	enc.lockedAddress = address
-	enc.lockedSince = &timeStamp
-	return true
+	return "", nil
 }
 
 /*
-isLockedAddress returns true if the given address is the currently locking one.
+removeObject removes the given key from storage together with its checksum and
+frees its usage.
 */
-func (enc *Encrypted) isLockedAddress(address string) bool {
-	if enc.IsLocked() && enc.lockedAddress == address {
-		return true
+func (enc *Encrypted) removeObject(key string) error {
+	err := enc.storage.Remove(key)
+	if err != nil {
+		return err
 	}
-	return false
+	err = enc.quotas.release(key)
+	if err != nil {
+		enc.warn("Failed to release usage of", key+":", err.Error())
+	}
+	return enc.checksums.remove(shared.OtObject, key)
 }
 
 /*
-checkLock returns whether the lock is valid. If yes this method will
-update the time stamp. NOTE: the timeout is only enforced if another peer tries
-to lock Encrypted in the meantime.
+verifyChecksum compares the given checksum to the one recorded for the object.
+If no checksum has been recorded yet the object is accepted.
 */
-func (enc *Encrypted) checkLock(address string) bool {
-	// if the address matches update time stamp and return true
-	if enc.lockedAddress == address {
-		//note: this allows locks to hold for longer than the timeout, as long as
-		//      no other peer requested a lock since.
-		newStamp := time.Now()
-		enc.lockedSince = &(newStamp)
-		return true
+func (enc *Encrypted) verifyChecksum(objType shared.ObjectType, identification, sum string) error {
+	recorded, err := enc.checksums.get(objType, identification)
+	if err != nil {
+		return err
+	}
+	if recorded != "" && recorded != sum {
+		return ErrCorrupted
 	}
-	return false
+	return nil
 }
 
 /*
@@ -170,9 +240,16 @@ func (enc *Encrypted) run() {
 	defer func() { enc.log("Background process stopped.") }()
 	// update peers once every minute
 	updateTicker := time.Tick(1 * time.Minute)
+	// check whether a scrub is due every minute
+	scrubTicker := time.Tick(1 * time.Minute)
+	// check for timed out locks
+	lockTicker := time.Tick(lockCheckInterval)
+	// quit is closed to stop any jobs started from here
+	quit := make(chan bool)
 	for {
 		select {
 		case <-enc.stop:
+			close(quit)
 			enc.wg.Done()
 			return
 		case <-updateTicker:
@@ -180,6 +257,10 @@ func (enc *Encrypted) run() {
 			if err != nil {
 				enc.warn("Failed to update peers:", err.Error())
 			}
+		case <-scrubTicker:
+			enc.startScrub(quit)
+		case <-lockTicker:
+			enc.expireLock()
 		}
 	}
 }
@@ -190,32 +271,31 @@ NOTE: for now will only connect to trusted peers.
 */
 func (enc *Encrypted) updatePeers() error {
 	// load peers from ORGDIR
-	path := enc.RootPath + "/" + shared.ORGDIR + "/" + shared.PEERSDIR
-	peersFiles, err := ioutil.ReadDir(path)
+	peers, err := enc.loadPeers()
 	if err != nil {
 		return err
 	}
-	var peers []*shared.Peer
-	for _, stat := range peersFiles {
-		data, err := ioutil.ReadFile(path + "/" + stat.Name())
-		if err != nil {
-			log.Println("Error loading peer " + stat.Name() + " from disk!")
-			continue
-		}
-		peer := &shared.Peer{}
-		err = json.Unmarshal(data, peer)
-		if err != nil {
-			log.Println("Error unmarshaling peer " + stat.Name() + " from disk!")
-			continue
-		}
-		peers = append(peers, peer)
+	// keep the peers used for authorizing messages up to date, this also
+	// revokes peers whose file has been removed
+	enc.setPeers(peers)
+	err = enc.refreshRoles()
+	if err != nil {
+		enc.warn("Failed to load roles:", err.Error())
 	}
 	// now update channel accordingly
 	for _, peer := range peers {
+		// files that couldn't be read are kept as they were
+		if peer == nil {
+			continue
+		}
 		// ignore self peer
 		if peer.Address == enc.Peer.Address {
 			continue
 		}
+		// never connect to revoked peers again
+		if enc.peers.isRevoked(peer.Address) {
+			continue
+		}
 		// ignore other encrypted peers (there are no operations we can do with them yet)
 		if !peer.Trusted {
 			// TODO: why CAN'T encrypted peers sync each other? They can just update their encrypted states accordingly... FIXME
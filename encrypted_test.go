@@ -0,0 +1,180 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/tinzenite/channel"
+	"github.com/tinzenite/shared"
+)
+
+const testAddress = "0123456789abcdef"
+
+/*
+fakeChannel records everything sent through it instead of talking to peers.
+File transfers are kept until completed with complete.
+*/
+type fakeChannel struct {
+	mutex    sync.Mutex
+	messages map[string][]string            // messages sent per address
+	files    map[string]func(channel.State) // callbacks of running file transfers per identification
+	sent     map[string][]string            // identifications of files sent per address
+	removed  map[string]bool                // addresses whose connection was removed
+	accepted map[string]bool                // addresses whose connection was accepted
+}
+
+func createFakeChannel() *fakeChannel {
+	return &fakeChannel{
+		messages: make(map[string][]string),
+		files:    make(map[string]func(channel.State)),
+		sent:     make(map[string][]string),
+		removed:  make(map[string]bool),
+		accepted: make(map[string]bool)}
+}
+
+func (fc *fakeChannel) Send(address, message string) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.messages[address] = append(fc.messages[address], message)
+	return nil
+}
+
+func (fc *fakeChannel) SendFile(address, path, identification string, f func(channel.State)) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.files[identification] = f
+	fc.sent[address] = append(fc.sent[address], identification)
+	return nil
+}
+
+func (fc *fakeChannel) AcceptConnection(address string) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.accepted[address] = true
+	return nil
+}
+
+func (fc *fakeChannel) RemoveConnection(address string) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.removed[address] = true
+	return nil
+}
+
+func (fc *fakeChannel) Address() (string, error)           { return testAddress, nil }
+func (fc *fakeChannel) ConnectionAddress() (string, error) { return testAddress, nil }
+func (fc *fakeChannel) ToxData() ([]byte, error)           { return nil, nil }
+func (fc *fakeChannel) Close()                             {}
+
+/*
+complete finishes the file transfer of the given identification with the given
+state. Returns whether such a transfer was running.
+*/
+func (fc *fakeChannel) complete(identification string, state channel.State) bool {
+	fc.mutex.Lock()
+	f, exists := fc.files[identification]
+	delete(fc.files, identification)
+	fc.mutex.Unlock()
+	if exists {
+		f(state)
+	}
+	return exists
+}
+
+/*
+filesSent returns the identifications of all files sent to the address.
+*/
+func (fc *fakeChannel) filesSent(address string) []string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return append([]string(nil), fc.sent[address]...)
+}
+
+/*
+notifies returns all notify messages sent to the address.
+*/
+func (fc *fakeChannel) notifies(address string) []notifyMessage {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	var notifies []notifyMessage
+	for _, message := range fc.messages[address] {
+		nm := notifyMessage{}
+		if json.Unmarshal([]byte(message), &nm) == nil && nm.Type == shared.MsgNotify {
+			notifies = append(notifies, nm)
+		}
+	}
+	return notifies
+}
+
+/*
+lockReplies returns all lock messages sent to the address.
+*/
+func (fc *fakeChannel) lockReplies(address string) []lockMessage {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	var replies []lockMessage
+	for _, message := range fc.messages[address] {
+		lm := lockMessage{}
+		if json.Unmarshal([]byte(message), &lm) == nil && lm.Type == shared.MsgLock {
+			replies = append(replies, lm)
+		}
+	}
+	return replies
+}
+
+/*
+createTestEncrypted returns an Encrypted in a temporary directory where
+testAddress is trusted and holds the exclusive lock. Its channel is a
+fakeChannel.
+*/
+func createTestEncrypted(t *testing.T) *Encrypted {
+	root := t.TempDir()
+	for _, dir := range []string{shared.ORGDIR + "/" + shared.PEERSDIR, shared.LOCALDIR, shared.RECEIVINGDIR, shared.SENDINGDIR} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enc := &Encrypted{
+		RootPath:  root,
+		storage:   createTestStorage(t),
+		checksums: createChecksumStore(root + "/" + shared.LOCALDIR + "/" + checksumDir),
+		quotas:    createQuotas(root + "/" + shared.LOCALDIR),
+		peers:     createPeerList(),
+		scrubber:  createScrubber(),
+		lock:      createLocker(),
+		channel:   createFakeChannel()}
+	enc.cInterface = createChanInterface(enc)
+	// keep the lock state from being written in the background after the test
+	enc.persistPending = true
+	enc.peers.trusted[testAddress] = true
+	if locked, _ := enc.lock.acquire(testAddress, false); !locked {
+		t.Fatal("failed to acquire lock")
+	}
+	return enc
+}
+
+/*
+fakeOf returns the fakeChannel of an Encrypted created by createTestEncrypted.
+*/
+func fakeOf(enc *Encrypted) *fakeChannel {
+	return enc.channel.(*fakeChannel)
+}
+
+/*
+requests returns all request messages sent to the address.
+*/
+func (fc *fakeChannel) requests(address string) []requestMessage {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	var requests []requestMessage
+	for _, message := range fc.messages[address] {
+		rm := requestMessage{}
+		if json.Unmarshal([]byte(message), &rm) == nil && rm.Type == shared.MsgRequest {
+			requests = append(requests, rm)
+		}
+	}
+	return requests
+}
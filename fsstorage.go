@@ -0,0 +1,294 @@
+package encrypted
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+shardDepth is the number of nested directories a key is sharded into.
+*/
+const shardDepth = 2
+
+/*
+shardWidth is the number of hex characters used per shard directory.
+*/
+const shardWidth = 2
+
+/*
+fsTempDir is the directory within the storage root where writes are prepared
+before being atomically moved into place.
+*/
+const fsTempDir = ".tmp"
+
+/*
+FileStorage is a Storage implementation that writes all data to a directory on
+the local file system. Keys are sharded into nested directories to keep the
+number of entries per directory low.
+*/
+type FileStorage struct {
+	root string // root directory of the storage
+}
+
+/*
+CreateFileStorage returns a FileStorage that stores all data below the given
+path. The directory is created if it doesn't exist yet.
+*/
+func CreateFileStorage(path string) (*FileStorage, error) {
+	if path == "" {
+		return nil, shared.ErrIllegalParameters
+	}
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// make sure root and temp dir exist
+	err = os.MkdirAll(filepath.Join(root, fsTempDir), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{root: root}, nil
+}
+
+/*
+Store writes the given data to the key. See StoreStream.
+*/
+func (fs *FileStorage) Store(key string, data []byte) error {
+	return fs.StoreStream(key, bytes.NewReader(data))
+}
+
+/*
+StoreStream writes all data read from the reader to the key. The write is
+atomic: the data is first written to a temporary file which is then synced and
+renamed into place.
+*/
+func (fs *FileStorage) StoreStream(key string, reader io.Reader) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Join(fs.root, fsTempDir), "store-")
+	if err != nil {
+		return err
+	}
+	// if anything fails remove the temp file
+	defer func() {
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}()
+	// temp files are private, stored data uses the same mode as all other files
+	err = temp.Chmod(shared.FILEPERMISSIONMODE)
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	_, err = io.Copy(temp, reader)
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	err = temp.Sync()
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	err = temp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp.Name(), path)
+	if err != nil {
+		return err
+	}
+	// sync directory so that the rename is durable
+	return syncDir(filepath.Dir(path))
+}
+
+/*
+Retrieve fetches the data for a key.
+*/
+func (fs *FileStorage) Retrieve(key string) ([]byte, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+/*
+RetrieveStream opens the data for a key for reading.
+*/
+func (fs *FileStorage) RetrieveStream(key string) (io.ReadCloser, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+/*
+Locate returns the path of the file holding the data of a key. As writes replace
+files atomically it is safe to read from it while new data is stored.
+*/
+func (fs *FileStorage) Locate(key string) (string, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+/*
+Remove is called to remove a key and associated data from storage.
+*/
+func (fs *FileStorage) Remove(key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+/*
+List returns up to limit keys that follow the given key. Keys are returned in
+the order of their sharded paths.
+*/
+func (fs *FileStorage) List(after string, limit int) ([]KeyInfo, error) {
+	if limit <= 0 {
+		return nil, shared.ErrIllegalParameters
+	}
+	// cursor is the relative path of the last key, everything up to it is skipped
+	var cursor string
+	if after != "" {
+		path, err := fs.path(after)
+		if err != nil {
+			return nil, err
+		}
+		cursor, err = filepath.Rel(fs.root, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var list []KeyInfo
+	err := fs.list(fs.root, 0, cursor, limit, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+/*
+list recursively walks the shard directories in sorted order, appending every
+key after the cursor to list until limit is reached.
+*/
+func (fs *FileStorage) list(dir string, depth int, cursor string, limit int, list *[]KeyInfo) error {
+	// ReadDir returns the entries sorted by name
+	stats, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, stat := range stats {
+		if len(*list) >= limit {
+			return nil
+		}
+		// ignore temp dir and files
+		if strings.HasPrefix(stat.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, stat.Name())
+		rel, err := filepath.Rel(fs.root, path)
+		if err != nil {
+			return err
+		}
+		// shard directories
+		if depth < shardDepth {
+			if !stat.IsDir() {
+				continue
+			}
+			// skip shards that lie completely before the cursor
+			if cursor != "" && len(rel) <= len(cursor) && rel < cursor[:len(rel)] {
+				continue
+			}
+			err = fs.list(path, depth+1, cursor, limit, list)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// keys
+		if stat.IsDir() || (cursor != "" && rel <= cursor) {
+			continue
+		}
+		*list = append(*list, KeyInfo{
+			Key:     stat.Name(),
+			Size:    stat.Size(),
+			ModTime: stat.ModTime()})
+	}
+	return nil
+}
+
+/*
+path returns the sharded path on disk for the given key. Returns an error if the
+key is not valid.
+*/
+func (fs *FileStorage) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	// shard by hash so that the layout is independent of the key format
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	elements := []string{fs.root}
+	for i := 0; i < shardDepth; i++ {
+		elements = append(elements, hash[i*shardWidth:(i+1)*shardWidth])
+	}
+	elements = append(elements, key)
+	return filepath.Join(elements...), nil
+}
+
+/*
+validKey checks whether a key can safely be used as a file name within the
+storage root.
+*/
+func validKey(key string) bool {
+	if key == "" || key == "." || key == ".." {
+		return false
+	}
+	// no hidden names, they are reserved for internal use (and temp files)
+	if strings.HasPrefix(key, ".") {
+		return false
+	}
+	if strings.ContainsAny(key, "/\\\x00") {
+		return false
+	}
+	return true
+}
+
+/*
+syncDir fsyncs the given directory.
+*/
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,113 @@
+package encrypted
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func createTestStorage(t *testing.T) *FileStorage {
+	fs, err := CreateFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestFileStorageReplace(t *testing.T) {
+	fs := createTestStorage(t)
+	if err := fs.Store("key", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Store("key", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.Retrieve("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("new")) {
+		t.Errorf("expected new data, got %q", data)
+	}
+	// no temp files may be left behind
+	stats, err := ioutil.ReadDir(filepath.Join(fs.root, fsTempDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 0 {
+		t.Errorf("expected empty temp dir, found %d files", len(stats))
+	}
+	// a failed write keeps the previous data
+	if err := fs.StoreStream("key", &failingReader{}); err == nil {
+		t.Fatal("expected error from failing reader")
+	}
+	data, err = fs.Retrieve("key")
+	if err != nil || !bytes.Equal(data, []byte("new")) {
+		t.Errorf("expected previous data after failed write, got %q, %v", data, err)
+	}
+}
+
+func TestFileStorageInvalidKeys(t *testing.T) {
+	fs := createTestStorage(t)
+	keys := []string{"", ".", "..", "../x", "a/b", `a\b`, ".hidden", "a\x00b"}
+	for _, key := range keys {
+		if err := fs.Store(key, []byte("data")); err != ErrInvalidKey {
+			t.Errorf("Store(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+		if _, err := fs.Retrieve(key); err != ErrInvalidKey {
+			t.Errorf("Retrieve(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+		if err := fs.Remove(key); err != ErrInvalidKey {
+			t.Errorf("Remove(%q): expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
+
+func TestFileStorageListPaging(t *testing.T) {
+	fs := createTestStorage(t)
+	const count = 100
+	for i := 0; i < count; i++ {
+		if err := fs.Store("key"+strconv.Itoa(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, limit := range []int{1, 7, count, count + 1} {
+		seen := make(map[string]bool)
+		var all []KeyInfo
+		var after string
+		for {
+			page, err := fs.List(after, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) > limit {
+				t.Fatalf("limit %d: page of %d keys", limit, len(page))
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, info := range page {
+				if seen[info.Key] {
+					t.Fatalf("limit %d: key %s listed twice", limit, info.Key)
+				}
+				seen[info.Key] = true
+			}
+			all = append(all, page...)
+			after = page[len(page)-1].Key
+		}
+		if len(all) != count {
+			t.Errorf("limit %d: expected %d keys, got %d", limit, count, len(all))
+		}
+	}
+	if _, err := fs.List("", 0); err == nil {
+		t.Error("expected error for zero limit")
+	}
+}
+
+type failingReader struct{}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	return 0, ErrCorrupted
+}
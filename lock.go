@@ -0,0 +1,501 @@
+package encrypted
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+locker holds the lock state of Encrypted. It is safe for concurrent use, all
+access to the state must go through its methods. A lock is either held
+exclusively by one peer (required for modifications) or shared by any number of
+peers that only read.
+*/
+type locker struct {
+	mutex   sync.Mutex
+	timeout time.Duration      // how long a lock is kept if no new messages are received
+	holders map[string]*holder // addresses holding the lock
+	counter uint64             // last issued fencing token
+	waiters []waiter           // peers waiting for the lock in order of request
+}
+
+/*
+holder is a single peer holding the lock.
+*/
+type holder struct {
+	read  bool      // whether the lock is shared
+	since time.Time // time of the last valid message of the holder
+	token uint64    // fencing token of the lock
+}
+
+/*
+waiter is a single peer waiting for the lock.
+*/
+type waiter struct {
+	address string
+	read    bool
+}
+
+/*
+grant describes a lock that was handed to a peer. Every grant carries a new,
+monotonically increasing fencing token.
+*/
+type grant struct {
+	address string
+	read    bool
+	token   uint64
+}
+
+/*
+createLocker returns an unlocked locker.
+*/
+func createLocker() *locker {
+	return &locker{
+		timeout: lockTimeout,
+		holders: make(map[string]*holder)}
+}
+
+/*
+setTimeout changes the timeout of the lock.
+*/
+func (l *locker) setTimeout(timeout time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.timeout = timeout
+}
+
+/*
+currentTimeout returns the current timeout of the lock.
+*/
+func (l *locker) currentTimeout() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.timeout
+}
+
+/*
+acquire locks for the given address, either shared for reading or exclusively.
+A shared lock is only granted while no peer holds or waits for the exclusive
+lock, the exclusive lock only if no one else holds any lock. Returns whether the
+lock was granted and the grant. If not granted the address is queued and will be
+handed the lock once it is its turn.
+*/
+func (l *locker) acquire(address string, read bool) (bool, grant) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// already held in the requested or a stronger mode: just refresh
+	if h := l.valid(address); h != nil && (read || !h.read) {
+		h.since = time.Now()
+		return true, grant{address: address, read: h.read, token: h.token}
+	}
+	// others waiting come first
+	if len(l.waiters) > 0 && l.waiters[0].address != address {
+		l.enqueue(address, read)
+		return false, grant{}
+	}
+	if !l.grantable(address, read) {
+		l.enqueue(address, read)
+		return false, grant{}
+	}
+	l.dequeue(address)
+	return true, l.set(address, read)
+}
+
+/*
+leave removes the given address from the waiters. Returns whether it was
+waiting.
+*/
+func (l *locker) leave(address string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.dequeue(address)
+}
+
+/*
+holds returns true if the lock is validly held by the given address. If write
+is true the lock must be held exclusively.
+*/
+func (l *locker) holds(address string, write bool) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	h := l.valid(address)
+	return h != nil && (!write || !h.read)
+}
+
+/*
+refresh updates the time stamp if the lock is validly held by the given address
+and returns whether that is the case. If write is true the lock must be held
+exclusively.
+*/
+func (l *locker) refresh(address string, write bool) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	h := l.valid(address)
+	if h == nil || (write && h.read) {
+		return false
+	}
+	h.since = time.Now()
+	return true
+}
+
+/*
+locked returns whether the lock is validly held by anyone.
+*/
+func (l *locker) locked() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for address := range l.holders {
+		if l.valid(address) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+writeLocked returns whether the exclusive lock is validly held by anyone.
+*/
+func (l *locker) writeLocked() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for address, h := range l.holders {
+		if !h.read && l.valid(address) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+fenced returns true if the given token is not stale: either no exclusive lock is
+validly held or it is held with exactly this token.
+*/
+func (l *locker) fenced(token uint64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for address, h := range l.holders {
+		if !h.read && l.valid(address) != nil {
+			return h.token == token
+		}
+	}
+	return true
+}
+
+/*
+current returns the fencing token of the exclusive lock if it is validly held by
+the given address, otherwise zero.
+*/
+func (l *locker) current(address string) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	h := l.valid(address)
+	if h == nil || h.read {
+		return 0
+	}
+	return h.token
+}
+
+/*
+clear removes all locks and hands the lock to the next waiters. Returns the
+addresses that held the lock and the new grants.
+*/
+func (l *locker) clear() ([]string, []grant) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var cleared []string
+	for address := range l.holders {
+		cleared = append(cleared, address)
+	}
+	l.holders = make(map[string]*holder)
+	return cleared, l.handOff()
+}
+
+/*
+release removes the lock only if it is validly held by the given address and
+hands it to the next waiters. Returns whether the lock was released and the new
+grants.
+*/
+func (l *locker) release(address string) (bool, []grant) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.valid(address) == nil {
+		return false, nil
+	}
+	delete(l.holders, address)
+	return true, l.handOff()
+}
+
+/*
+expire removes all locks that have timed out and hands the lock to the next
+waiters. Holders for which busy returns true are refreshed instead as they are
+still transferring data, unless the lock has been granted to others since.
+Returns the addresses whose locks expired and the new grants.
+*/
+func (l *locker) expire(busy func(address string) bool) ([]string, []grant) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var expired []string
+	for address, h := range l.holders {
+		if l.valid(address) != nil {
+			continue
+		}
+		// only if no one else has been granted the lock in the meantime
+		if busy(address) && l.grantable(address, h.read) {
+			h.since = time.Now()
+			continue
+		}
+		expired = append(expired, address)
+		delete(l.holders, address)
+	}
+	// a free lock may still have waiters if the last hand off failed
+	return expired, l.handOff()
+}
+
+/*
+handOff grants the lock to waiters in order for as long as possible: all shared
+waiters at the front of the queue, or the first exclusive waiter once the lock
+is free. NOTE: the mutex must be held when calling this.
+*/
+func (l *locker) handOff() []grant {
+	var grants []grant
+	for len(l.waiters) > 0 {
+		next := l.waiters[0]
+		if !l.grantable(next.address, next.read) {
+			break
+		}
+		l.waiters = l.waiters[1:]
+		grants = append(grants, l.set(next.address, next.read))
+	}
+	return grants
+}
+
+/*
+grantable returns whether the lock can be granted to the address in the given
+mode, ignoring the waiters. NOTE: the mutex must be held when calling this.
+*/
+func (l *locker) grantable(address string, read bool) bool {
+	for other, h := range l.holders {
+		if other == address || l.valid(other) == nil {
+			continue
+		}
+		// exclusive locks block everything, shared only exclusive requests
+		if !h.read || !read {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+set locks the address in the given mode with a new fencing token. NOTE: the
+mutex must be held when calling this.
+*/
+func (l *locker) set(address string, read bool) grant {
+	l.counter++
+	l.holders[address] = &holder{
+		read:  read,
+		since: time.Now(),
+		token: l.counter}
+	return grant{address: address, read: read, token: l.counter}
+}
+
+/*
+enqueue appends the address to the waiters if it isn't waiting yet. NOTE: the
+mutex must be held when calling this.
+*/
+func (l *locker) enqueue(address string, read bool) {
+	for i, w := range l.waiters {
+		if w.address == address {
+			// keep position but update mode
+			l.waiters[i].read = read
+			return
+		}
+	}
+	l.waiters = append(l.waiters, waiter{address: address, read: read})
+}
+
+/*
+dequeue removes the address from the waiters. Returns whether it was waiting.
+NOTE: the mutex must be held when calling this.
+*/
+func (l *locker) dequeue(address string) bool {
+	for i, w := range l.waiters {
+		if w.address == address {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+valid returns the holder for the address if it holds the lock and hasn't timed
+out, otherwise nil. NOTE: the mutex must be held when calling this.
+*/
+func (l *locker) valid(address string) *holder {
+	h, exists := l.holders[address]
+	if !exists || time.Since(h.since) >= l.timeout {
+		return nil
+	}
+	return h
+}
+
+/*
+IsLocked returns whether this Encrypted is currently locked to a peer. NOTE:
+does NOT update the time. That can only be done internally upon receiving valid
+messages.
+*/
+func (enc *Encrypted) IsLocked() bool {
+	// if timed out: reset
+	enc.expireLock()
+	return enc.lock.locked()
+}
+
+/*
+SetLockTimeout sets how long a lock is kept if no new messages are received
+from the peer holding it.
+*/
+func (enc *Encrypted) SetLockTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	enc.lock.setTimeout(timeout)
+}
+
+/*
+ClearLock can be used to clear an existing lock. Internally called when a lock is
+released. If other peers are waiting the lock is handed to the next one. NOTE:
+this method is public to allow forcing a lock clear.
+*/
+func (enc *Encrypted) ClearLock() {
+	cleared, next := enc.lock.clear()
+	for _, address := range cleared {
+		enc.sendLockStatus(address, statusReleased, grant{})
+	}
+	enc.onUnlocked(cleared, next)
+}
+
+/*
+setLock can set the lock, shared if read is true. The return value signifies
+whether the lock was successful. If not, it most likely means that Encrypted is
+already locked.
+*/
+func (enc *Encrypted) setLock(address string, read bool) (bool, grant) {
+	// clean up after a timed out lock first
+	enc.expireLock()
+	locked, granted := enc.lock.acquire(address, read)
+	if !locked {
+		return false, grant{}
+	}
+	log.Println("Encrypted: locked to", address[:8], "as", modeOf(granted.read))
+	enc.persistLock()
+	return true, granted
+}
+
+/*
+releaseLock releases the lock if it is held by the given address. Returns
+whether the lock was released.
+*/
+func (enc *Encrypted) releaseLock(address string) bool {
+	released, next := enc.lock.release(address)
+	if !released {
+		return false
+	}
+	enc.onUnlocked([]string{address}, next)
+	return true
+}
+
+/*
+leaveLockQueue removes the given address from the peers waiting for the lock.
+Returns whether it was waiting.
+*/
+func (enc *Encrypted) leaveLockQueue(address string) bool {
+	if !enc.lock.leave(address) {
+		return false
+	}
+	enc.persistLock()
+	return true
+}
+
+/*
+checkToken returns whether the given fencing token is valid for the address. A
+token of zero is sent by peers that don't support fencing, so it is accepted if
+the address holds the exclusive lock.
+*/
+func (enc *Encrypted) checkToken(address string, token uint64) bool {
+	current := enc.lock.current(address)
+	return current != 0 && (token == 0 || token == current)
+}
+
+/*
+checkLock returns whether the lock is valid. If write is true the lock must be
+held exclusively. If yes this method will update the time stamp.
+*/
+func (enc *Encrypted) checkLock(address string, write bool) bool {
+	return enc.lock.refresh(address, write)
+}
+
+/*
+expireLock clears all locks that have timed out, notifying the peers that held
+them. Called regularly from the background process so that a crashed peer can't
+keep Encrypted locked.
+*/
+func (enc *Encrypted) expireLock() {
+	// long transfers don't send messages, so their locks are kept while data
+	// is moving. Pushes whose data never arrives don't count, their peer may
+	// have crashed.
+	expired, next := enc.lock.expire(func(address string) bool {
+		return enc.cInterface.sends.busy(address) || enc.cInterface.transferring(address)
+	})
+	if len(expired) == 0 && len(next) == 0 {
+		return
+	}
+	for _, address := range expired {
+		log.Println("Encrypted: lock of", address[:8], "expired")
+		enc.sendLockStatus(address, statusExpired, grant{})
+	}
+	enc.onUnlocked(expired, next)
+}
+
+/*
+onUnlocked cleans up after the locks of the given addresses have been removed
+and notifies the peers the lock has been handed to, if any.
+*/
+func (enc *Encrypted) onUnlocked(addresses []string, next []grant) {
+	for _, granted := range next {
+		log.Println("Encrypted: locked to waiting", granted.address[:8], "as", modeOf(granted.read))
+		enc.sendLockStatus(granted.address, statusGranted, granted)
+	}
+	for _, address := range addresses {
+		log.Println("Encrypted: released from", address[:8])
+		//clean up any outstanding file transfers for cleared address (but not ones receiving data!)
+		var toRemove []string
+		enc.cInterface.mutex.Lock()
+		for key := range enc.cInterface.allowedTransfers {
+			if strings.HasPrefix(key, address) && !enc.cInterface.moving[key] {
+				toRemove = append(toRemove, key)
+			}
+		}
+		for _, key := range toRemove {
+			delete(enc.cInterface.allowedTransfers, key)
+		}
+		enc.cInterface.mutex.Unlock()
+		// drop queued transfers and free the slots of the removed ones
+		enc.cInterface.sends.cancel(address)
+		enc.cInterface.receives.cancel(address)
+		for _, key := range toRemove {
+			enc.cInterface.receives.done(key)
+		}
+	}
+	enc.persistLock()
+}
+
+/*
+sendLockStatus sends the given lock status to the peer.
+*/
+func (enc *Encrypted) sendLockStatus(address, status string, granted grant) {
+	reply := createLockReply(status, granted)
+	enc.channel.Send(address, reply.JSON())
+}
@@ -0,0 +1,228 @@
+package encrypted
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestLockerModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    bool // mode of the first holder, true for read
+		second   bool // mode requested by the second address
+		expected bool // whether the second address is granted the lock
+	}{
+		{"shared after shared", true, true, true},
+		{"exclusive after shared", true, false, false},
+		{"shared after exclusive", false, true, false},
+		{"exclusive after exclusive", false, false, false},
+	}
+	for _, test := range tests {
+		l := createLocker()
+		if ok, _ := l.acquire("a", test.first); !ok {
+			t.Fatalf("%s: first lock not granted", test.name)
+		}
+		ok, _ := l.acquire("b", test.second)
+		if ok != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ok)
+		}
+		// once a releases, a queued b must be handed the lock
+		released, next := l.release("a")
+		if !released {
+			t.Errorf("%s: release failed", test.name)
+		}
+		if !test.expected && (len(next) != 1 || next[0].address != "b") {
+			t.Errorf("%s: expected hand off to b, got %v", test.name, next)
+		}
+		if !l.holds("b", !test.second) {
+			t.Errorf("%s: b doesn't hold the lock", test.name)
+		}
+	}
+}
+
+func TestLockerQueueOrder(t *testing.T) {
+	l := createLocker()
+	l.acquire("a", false)
+	l.acquire("b", true)
+	l.acquire("c", true)
+	l.acquire("d", false)
+	// the shared waiters at the front are granted together, the exclusive one waits
+	_, next := l.release("a")
+	if len(next) != 2 || next[0].address != "b" || next[1].address != "c" {
+		t.Fatalf("expected b and c to be granted, got %v", next)
+	}
+	if next[0].token >= next[1].token {
+		t.Error("tokens must increase")
+	}
+	l.release("b")
+	_, next = l.release("c")
+	if len(next) != 1 || next[0].address != "d" || next[0].read {
+		t.Fatalf("expected exclusive grant to d, got %v", next)
+	}
+}
+
+func TestLockerExpire(t *testing.T) {
+	l := createLocker()
+	l.setTimeout(10 * time.Millisecond)
+	l.acquire("a", false)
+	l.acquire("b", false)
+	time.Sleep(20 * time.Millisecond)
+	if l.refresh("a", true) {
+		t.Error("refresh of expired lock succeeded")
+	}
+	expired, next := l.expire(func(string) bool { return false })
+	if len(expired) != 1 || expired[0] != "a" {
+		t.Errorf("expected a to expire, got %v", expired)
+	}
+	if len(next) != 1 || next[0].address != "b" {
+		t.Errorf("expected hand off to b, got %v", next)
+	}
+	if !l.fenced(next[0].token) {
+		t.Error("token of new holder must be valid")
+	}
+}
+
+func TestLockerExpireBusy(t *testing.T) {
+	l := createLocker()
+	l.setTimeout(10 * time.Millisecond)
+	l.acquire("a", false)
+	time.Sleep(20 * time.Millisecond)
+	// a holder that is still transferring keeps the lock
+	expired, _ := l.expire(func(address string) bool { return address == "a" })
+	if len(expired) != 0 || !l.holds("a", true) {
+		t.Fatal("busy holder lost the lock")
+	}
+	time.Sleep(20 * time.Millisecond)
+	expired, _ = l.expire(func(string) bool { return false })
+	if len(expired) != 1 {
+		t.Error("idle holder kept the lock")
+	}
+}
+
+func TestLockerConcurrent(t *testing.T) {
+	l := createLocker()
+	l.setTimeout(5 * time.Millisecond)
+	var tokensMutex sync.Mutex
+	tokens := make(map[uint64]string)
+	record := func(grants ...grant) {
+		tokensMutex.Lock()
+		defer tokensMutex.Unlock()
+		for _, g := range grants {
+			if g.token == 0 {
+				continue
+			}
+			if other, exists := tokens[g.token]; exists && other != g.address {
+				t.Errorf("token %d granted to %s and %s", g.token, other, g.address)
+			}
+			tokens[g.token] = g.address
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(address string, seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for j := 0; j < 500; j++ {
+				switch random.Intn(6) {
+				case 0:
+					ok, g := l.acquire(address, random.Intn(2) == 0)
+					if ok {
+						record(g)
+					}
+				case 1:
+					_, next := l.release(address)
+					record(next...)
+				case 2:
+					l.refresh(address, random.Intn(2) == 0)
+				case 3:
+					_, next := l.expire(func(address string) bool {
+						return address == "peer0"
+					})
+					record(next...)
+				case 4:
+					l.mutex.Lock()
+					next := l.handOff()
+					l.mutex.Unlock()
+					record(next...)
+				case 5:
+					l.leave(address)
+				}
+				checkLockInvariant(t, l)
+			}
+		}("peer"+strconv.Itoa(i), int64(i))
+	}
+	wg.Wait()
+}
+
+/*
+checkLockInvariant fails the test if an exclusive lock is held together with any
+other lock.
+*/
+func checkLockInvariant(t *testing.T, l *locker) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var holders, writers int
+	for address, h := range l.holders {
+		if l.valid(address) == nil {
+			continue
+		}
+		holders++
+		if !h.read {
+			writers++
+		}
+	}
+	if writers > 1 || (writers == 1 && holders > 1) {
+		t.Errorf("exclusive lock shared: %d holders, %d exclusive", holders, writers)
+	}
+}
+
+func TestExpireLockCrashedPusher(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	enc.SetLockTimeout(10 * time.Millisecond)
+	const waiting = "fedcba9876543210"
+	enc.peers.trusted[waiting] = true
+	// the holder pushes but crashes before sending the file
+	pm := pushMessage{PushMessage: shared.CreatePushMessage("object", shared.OtObject)}
+	c.OnMessage(testAddress, pm.JSON())
+	if locked, _ := enc.setLock(waiting, false); locked {
+		t.Fatal("expected waiter to be queued")
+	}
+	// the waiter's own lock would time out too, so check right after each expiry
+	for i := 0; i < 3 && !enc.lock.holds(waiting, true); i++ {
+		time.Sleep(20 * time.Millisecond)
+		enc.expireLock()
+	}
+	if enc.lock.holds(testAddress, false) {
+		t.Error("crashed pusher kept the lock")
+	}
+	if !enc.lock.holds(waiting, true) {
+		t.Error("waiter was not handed the lock")
+	}
+	if c.receives.busy(testAddress) {
+		t.Error("receive slot of crashed pusher was not freed")
+	}
+	// once data is moving the lock is kept until the transfer ends
+	pm = pushMessage{PushMessage: shared.CreatePushMessage("other", shared.OtObject)}
+	c.OnMessage(waiting, pm.JSON())
+	if allowed, _ := c.OnAllowFile(waiting, "other"); !allowed {
+		t.Fatal("expected file to be allowed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	enc.expireLock()
+	if !enc.lock.holds(waiting, true) {
+		t.Error("holder receiving data lost the lock")
+	}
+	c.OnFileCanceled(waiting, c.buildKey(waiting, "other"))
+	time.Sleep(20 * time.Millisecond)
+	enc.expireLock()
+	if enc.lock.holds(waiting, false) {
+		t.Error("holder kept the lock after its transfer was canceled")
+	}
+}
@@ -0,0 +1,162 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+lockState is the persisted form of the lock and the pending transfer allowances
+so that a sync can continue after a restart.
+*/
+type lockState struct {
+	Holders   map[string]holderState `json:"holders"`
+	Counter   uint64                 `json:"counter"`
+	Waiters   []waiterState          `json:"waiters"`
+	Transfers map[string]pushMessage `json:"transfers"`
+}
+
+/*
+holderState is the persisted form of a holder.
+*/
+type holderState struct {
+	Read  bool      `json:"read"`
+	Since time.Time `json:"since"`
+	Token uint64    `json:"token"`
+}
+
+/*
+waiterState is the persisted form of a waiter.
+*/
+type waiterState struct {
+	Address string `json:"address"`
+	Read    bool   `json:"read"`
+}
+
+/*
+snapshot writes the current state of the locker to the given lockState.
+*/
+func (l *locker) snapshot(state *lockState) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	state.Holders = make(map[string]holderState)
+	for address, h := range l.holders {
+		state.Holders[address] = holderState{
+			Read:  h.read,
+			Since: h.since,
+			Token: h.token}
+	}
+	state.Counter = l.counter
+	state.Waiters = nil
+	for _, w := range l.waiters {
+		state.Waiters = append(state.Waiters, waiterState{
+			Address: w.address,
+			Read:    w.read})
+	}
+}
+
+/*
+restore sets the state of the locker from the given lockState.
+*/
+func (l *locker) restore(state *lockState) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.holders = make(map[string]*holder)
+	for address, h := range state.Holders {
+		// refreshes are not persisted, so holders get a full timeout after a restart
+		l.holders[address] = &holder{
+			read:  h.Read,
+			since: time.Now(),
+			token: h.Token}
+	}
+	l.counter = state.Counter
+	l.waiters = nil
+	for _, w := range state.Waiters {
+		l.waiters = append(l.waiters, waiter{
+			address: w.Address,
+			read:    w.Read})
+	}
+}
+
+/*
+storeLockState writes the lock state and the pending transfer allowances to
+LOCALDIR.
+*/
+func (enc *Encrypted) storeLockState() error {
+	state := &lockState{}
+	enc.lock.snapshot(state)
+	enc.cInterface.mutex.Lock()
+	state.Transfers = make(map[string]pushMessage)
+	for key, pm := range enc.cInterface.allowedTransfers {
+		state.Transfers[key] = pm
+	}
+	enc.cInterface.mutex.Unlock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to temp file first so that a crash never leaves a broken state
+	path := enc.RootPath + "/" + shared.LOCALDIR + "/" + lockStateJSON
+	enc.stateMutex.Lock()
+	defer enc.stateMutex.Unlock()
+	return writeFileAtomic(path, data)
+}
+
+/*
+loadLockState restores the lock state and the pending transfer allowances from
+LOCALDIR. A missing state is not an error.
+*/
+func (enc *Encrypted) loadLockState() error {
+	data, err := ioutil.ReadFile(enc.RootPath + "/" + shared.LOCALDIR + "/" + lockStateJSON)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &lockState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return err
+	}
+	enc.lock.restore(state)
+	enc.cInterface.mutex.Lock()
+	for key, pm := range state.Transfers {
+		enc.cInterface.allowedTransfers[key] = pm
+	}
+	enc.cInterface.mutex.Unlock()
+	return nil
+}
+
+/*
+persistLock schedules storing the lock state. Changes within persistDelay are
+written together so that a sync of many objects doesn't rewrite the state for
+every single one.
+*/
+func (enc *Encrypted) persistLock() {
+	enc.persistMutex.Lock()
+	defer enc.persistMutex.Unlock()
+	if enc.persistPending {
+		return
+	}
+	enc.persistPending = true
+	time.AfterFunc(persistDelay, enc.flushLock)
+}
+
+/*
+flushLock stores the lock state right away, logging any failure.
+*/
+func (enc *Encrypted) flushLock() {
+	// reset first so that changes made while writing schedule another write
+	enc.persistMutex.Lock()
+	enc.persistPending = false
+	enc.persistMutex.Unlock()
+	err := enc.storeLockState()
+	if err != nil {
+		enc.warn("Failed to store lock state:", err.Error())
+	}
+}
@@ -0,0 +1,57 @@
+package encrypted
+
+import (
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestLockStateRoundTrip(t *testing.T) {
+	enc := createTestEncrypted(t)
+	const waiting = "fedcba9876543210"
+	enc.peers.trusted[waiting] = true
+	if locked, _ := enc.lock.acquire(waiting, true); locked {
+		t.Fatal("expected waiter to be queued")
+	}
+	pm := pushMessage{PushMessage: shared.CreatePushMessage("object", shared.OtObject)}
+	enc.cInterface.OnMessage(testAddress, pm.JSON())
+	key := enc.cInterface.buildKey(testAddress, "object")
+	if err := enc.storeLockState(); err != nil {
+		t.Fatal(err)
+	}
+	// restore into a fresh instance on the same directory, as after a restart
+	restored := createTestEncrypted(t)
+	restored.RootPath = enc.RootPath
+	restored.lock = createLocker()
+	restored.peers.trusted[waiting] = true
+	if err := restored.loadLockState(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.lock.current(testAddress) != enc.lock.current(testAddress) {
+		t.Errorf("expected token %d, got %d", enc.lock.current(testAddress), restored.lock.current(testAddress))
+	}
+	if !restored.lock.holds(testAddress, true) {
+		t.Error("expected exclusive holder to be restored")
+	}
+	if restored.lock.counter != enc.lock.counter {
+		t.Errorf("expected counter %d, got %d", enc.lock.counter, restored.lock.counter)
+	}
+	if len(restored.lock.waiters) != 1 || restored.lock.waiters[0].address != waiting || !restored.lock.waiters[0].read {
+		t.Errorf("expected shared waiter to be restored, got %v", restored.lock.waiters)
+	}
+	restored.cInterface.mutex.Lock()
+	allowed, exists := restored.cInterface.allowedTransfers[key]
+	restored.cInterface.mutex.Unlock()
+	if !exists || allowed.Identification != "object" || allowed.Token != enc.lock.current(testAddress) {
+		t.Errorf("expected allowance to be restored, got %v", allowed)
+	}
+	// the restored allowance is accepted once the file arrives
+	if ok, _ := restored.cInterface.OnAllowFile(testAddress, "object"); !ok {
+		t.Error("expected restored allowance to be accepted")
+	}
+	// the waiter is handed the lock once the holder releases
+	restored.releaseLock(testAddress)
+	if !restored.lock.holds(waiting, false) {
+		t.Error("expected restored waiter to be handed the lock")
+	}
+}
@@ -1,9 +1,12 @@
 package encrypted
 
 import (
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/tinzenite/channel"
 	"github.com/tinzenite/shared"
@@ -13,30 +16,34 @@ import (
 handleLockMessage handles the logic upon receiving a LockMessage. Notably this
 includes allowing or disallowing a lock for a specific time frame.
 */
-func (c *chaninterface) handleLockMessage(address string, lm *shared.LockMessage) {
+func (c *chaninterface) handleLockMessage(address string, lm *lockMessage) {
 	switch lm.Action {
 	case shared.LoRequest:
-		if c.enc.isLockedAddress(address) {
-			// we catch this to avoid having peers trying to sync multiple times at the same time
-			log.Println("Relock tried for same address, ignoring!")
-			return
+		read := lm.Mode == modeRead
+		// peers that may not write anything only receive the shared lock
+		if !read && !c.enc.roleOf(address).includes(RoleObjects) {
+			log.Println("handleLockMessage: peer may only read, granting shared lock to", address[:8])
+			read = true
 		}
-		if c.enc.setLock(address) {
-			// if successful notify peer of success
-			accept := shared.CreateLockMessage(shared.LoAccept)
-			c.enc.channel.Send(address, accept.JSON())
+		// a peer that already holds the lock is granted it again with its current
+		// token, so that it can recover if it missed the previous reply
+		locked, granted := c.enc.setLock(address, read)
+		if !locked {
+			// peer has been queued and will receive a grant once it is its turn
+			log.Println("Lock busy, queued", address[:8])
+			c.enc.sendLockStatus(address, statusDenied, grant{})
+			return
 		}
-		// if not successful send release to signify that peer has no lock
-		deny := shared.CreateLockMessage(shared.LoRelease)
-		c.enc.channel.Send(address, deny.JSON())
-		return
+		// notify peer of success, including the fencing token
+		c.enc.sendLockStatus(address, statusGranted, granted)
 	case shared.LoRelease:
-		if c.enc.isLockedAddress(address) {
-			c.enc.ClearLock()
-			// TODO notify of clear?
+		// peers that are still waiting for the lock may give up too
+		if c.enc.releaseLock(address) || c.enc.leaveLockQueue(address) {
+			c.enc.sendLockStatus(address, statusReleased, grant{})
 			return
 		}
 		log.Println("handleLockMessage: WARNING: received release request from invalid peer!", address[:8])
+		c.enc.sendLockStatus(address, statusUnlocked, grant{})
 	default:
 		log.Println("handleLockMessage: Invalid action received!")
 	}
@@ -44,31 +51,66 @@ func (c *chaninterface) handleLockMessage(address string, lm *shared.LockMessage
 
 /*
 handleRequestMessage handles the logic upon receiving a RequestMessage. NOTE:
-will only be actually handled if Encrypted is currently locked.
+will only be actually handled if Encrypted is currently locked, a shared lock is
+enough. The request is served once the send scheduler allows it.
 */
-func (c *chaninterface) handleRequestMessage(address string, rm *shared.RequestMessage) {
-	var data []byte           // data to send
+func (c *chaninterface) handleRequestMessage(address string, rm *requestMessage) {
+	if !validIdentification(rm.Identification) {
+		log.Println("handleRequestMessage: invalid identification, refusing!")
+		return
+	}
+	if rm.Chunk < 0 || rm.ChunkSize < 0 || (rm.Chunk > 0 && rm.ChunkSize == 0) {
+		log.Println("handleRequestMessage: invalid chunk, refusing!")
+		return
+	}
+	name := rm.Identification
+	if rm.ChunkSize > 0 {
+		name = chunkName(name, rm.Chunk)
+	}
+	key := c.buildKey(address, name)
+	c.sends.submit(address, key, func() bool {
+		return c.serveRequest(address, key, rm)
+	})
+}
+
+/*
+serveRequest sends the data requested by the RequestMessage. Returns whether a
+transfer was started.
+*/
+func (c *chaninterface) serveRequest(address, key string, rm *requestMessage) bool {
+	var direct string         // path of a file holding the data, if available
 	var identification string // identification for writing temp file
 	var err error
-	// check file type and fetch data accordingly
+	// check file type and locate data accordingly
 	switch rm.ObjType {
 	case shared.OtObject:
-		// fetch data for normal objects from storage
-		data, err = c.enc.storage.Retrieve(rm.Identification)
+		// normal objects can only be sent directly if storage can locate them
+		direct, err = c.enc.locateObject(rm.Identification)
 		identification = rm.Identification
 	case shared.OtModel:
 		// model is read from specially named file
-		data, err = ioutil.ReadFile(c.enc.RootPath + "/" + shared.IDMODEL)
+		direct = c.enc.RootPath + "/" + shared.IDMODEL
 		identification = shared.IDMODEL
 	case shared.OtPeer:
-		data, err = ioutil.ReadFile(c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.PEERSDIR + "/" + rm.Identification)
+		direct, err = c.enc.peerPath(rm.Identification)
 		identification = rm.Identification
 	case shared.OtAuth:
-		data, err = ioutil.ReadFile(c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.AUTHJSON)
+		direct = c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.AUTHJSON
 		identification = rm.Identification
 	default:
 		log.Println("handleRequestMessage: Invalid ObjType requested!", rm.ObjType.String())
-		return
+		return false
+	}
+	// open data
+	open := func() (io.ReadCloser, error) {
+		if direct != "" {
+			return os.Open(direct)
+		}
+		return c.enc.retrieveObject(rm.Identification)
+	}
+	var reader io.ReadCloser
+	if err == nil {
+		reader, err = open()
 	}
 	// if error return
 	if err != nil {
@@ -79,83 +121,497 @@ func (c *chaninterface) handleRequestMessage(address string, rm *shared.RequestM
 		// notify sender that it don't exist in any case
 		nm := shared.CreateNotifyMessage(shared.NoMissing, identification, rm.ObjType)
 		c.enc.channel.Send(address, nm.JSON())
+		return false
+	}
+	defer func() {
+		if reader != nil {
+			reader.Close()
+		}
+	}()
+	// chunked requests only send the requested part. Chunks can't be verified on
+	// their own, so the whole object is verified before the first one is served.
+	if rm.ChunkSize > 0 {
+		if rm.Chunk == 0 {
+			hr := createHashingReader(reader)
+			_, err = io.Copy(ioutil.Discard, hr)
+			if err == nil {
+				err = c.enc.verifyChecksum(rm.ObjType, rm.Identification, hr.Sum())
+			}
+			if err == ErrCorrupted {
+				log.Println("handleRequestMessage: verification of", rm.Identification, "failed:", err)
+				nm := createNotifyMessage(shared.NoMissing, identification, rm.ObjType, reasonCorrupted)
+				c.enc.channel.Send(address, nm.JSON())
+				return false
+			}
+			if err != nil {
+				log.Println("handleRequestMessage: failed to read data:", err)
+				return false
+			}
+			// start over for reading the chunk
+			reader.Close()
+			reader, err = open()
+			if err != nil {
+				log.Println("handleRequestMessage: failed to open data:", err)
+				reader = nil
+				return false
+			}
+		}
+		return c.sendChunk(address, key, rm, identification, reader)
+	}
+	// if the data is in a file already send it directly, otherwise write temp file
+	filePath := direct
+	if direct == "" {
+		filePath, err = c.transferPath(shared.SENDINGDIR, address, identification)
+		if err != nil {
+			log.Println("handleRequestMessage: invalid temp file:", err)
+			return false
+		}
+	}
+	// write data to temp sending file or just read it, computing the checksum along the way
+	hr := createHashingReader(reader)
+	if direct == "" {
+		err = writeStream(filePath, hr)
+	} else {
+		_, err = io.Copy(ioutil.Discard, hr)
+	}
+	if err != nil {
+		log.Println("handleRequestMessage: failed to read data:", err)
+		return false
+	}
+	// verify data against recorded checksum, never serve corrupted data
+	err = c.enc.verifyChecksum(rm.ObjType, rm.Identification, hr.Sum())
+	if err != nil {
+		log.Println("handleRequestMessage: verification of", rm.Identification, "failed:", err)
+		if direct == "" {
+			os.Remove(filePath)
+		}
+		nm := createNotifyMessage(shared.NoMissing, identification, rm.ObjType, reasonCorrupted)
+		c.enc.channel.Send(address, nm.JSON())
+		return false
+	}
+	return c.sendFile(address, key, filePath, rm.Identification, direct == "")
+}
+
+/*
+handlePushMessage handles the logic upon receiving a PushMessage.
+*/
+func (c *chaninterface) handlePushMessage(address string, pm *pushMessage) {
+	if !validIdentification(pm.Identification) {
+		log.Println("handlePushMessage: invalid identification, refusing!")
+		return
+	}
+	// reject pushes made under a stale lock
+	if !c.enc.checkToken(address, pm.Token) {
+		log.Println("handlePushMessage: stale fencing token, refusing", pm.Identification)
+		c.enc.sendLockStatus(address, statusUnlocked, grant{})
 		return
 	}
-	// path for temp file
-	filePath := c.enc.RootPath + "/" + shared.SENDINGDIR + "/" + c.buildKey(address, identification)
-	// write data to temp sending file
-	err = ioutil.WriteFile(filePath, data, shared.FILEPERMISSIONMODE)
+	if pm.Size < 0 {
+		log.Println("handlePushMessage: invalid size, refusing", pm.Identification)
+		return
+	}
+	if pm.isChunked() && !pm.validChunks() {
+		log.Println("handlePushMessage: invalid chunks, refusing", pm.Identification)
+		return
+	}
+	// without an advertised size the limit could only be checked after the whole
+	// object has been transferred, so such pushes must be chunked
+	if !pm.isChunked() && pm.Size == 0 && c.enc.quotas.maxSize(pm.ObjType) > 0 {
+		log.Println("handlePushMessage: size unknown but limited, refusing", pm.Identification)
+		c.refusePush(address, pm, reasonTooLarge)
+		return
+	}
+	// refuse objects that are too large or would exceed a quota before transferring them
+	if !c.enc.quotas.fits(pm.ObjType, pm.expectedSize()) {
+		log.Println("handlePushMessage: object too large, refusing", pm.Identification)
+		c.refusePush(address, pm, reasonTooLarge)
+		return
+	}
+	if pm.ObjType == shared.OtObject && !c.enc.quotas.allows(address, pm.Identification, pm.expectedSize()) {
+		log.Println("handlePushMessage: quota exceeded, refusing", pm.Identification)
+		c.refusePush(address, pm, reasonQuota)
+		return
+	}
+	// remember the token of the lock the push was allowed under
+	pm.Token = c.enc.lock.current(address)
+	// note that file transfer is allowed for when file is received
+	key := c.buildKey(address, pm.Identification)
+	// if we reach this, allow and store push message too
+	c.mutex.Lock()
+	c.allowedTransfers[key] = *pm
+	c.mutex.Unlock()
+	// persist so that the transfer is still allowed after a restart
+	c.enc.persistLock()
+	// request the data once the receive scheduler allows it
+	c.receives.submit(address, key, func() bool {
+		log.Println("Receiving", pm.Identification)
+		// chunked pushes request the first missing chunk instead of the whole object
+		if pm.isChunked() {
+			c.startChunkedPush(address, key, pm)
+			return true
+		}
+		// notify that we have received the push message once pacing allows it
+		rm := requestMessage{
+			RequestMessage: shared.CreateRequestMessage(pm.ObjType, pm.Identification),
+			MaxSize:        c.enc.quotas.maxSize(pm.ObjType)}
+		// the size is only charged once received, see OnFileReceived
+		c.throttle(address, false, 0, func() {
+			c.enc.channel.Send(address, rm.JSON())
+		})
+		return true
+	})
+}
+
+/*
+storeReceived verifies the completely received file at path and writes it to
+its destination according to the push message.
+*/
+func (c *chaninterface) storeReceived(address, path string, pm *pushMessage) {
+	// if another lock has been granted since the push was allowed, refuse it
+	if !c.enc.lock.fenced(pm.Token) {
+		log.Println("storeReceived: lock changed since push, discarding", pm.Identification)
+		return
+	}
+	// open data, it is streamed to its destination to avoid loading it into memory
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("storeReceived: failed to open file:", err)
+		return
+	}
+	defer file.Close()
+	// the actual size may differ from what was advertised, so check again
+	stat, err := file.Stat()
+	if err != nil {
+		log.Println("storeReceived: failed to stat file:", err)
+		return
+	}
+	if !c.enc.quotas.fits(pm.ObjType, stat.Size()) {
+		log.Println("storeReceived: object too large, discarding", pm.Identification)
+		c.refusePush(address, pm, reasonTooLarge)
+		return
+	}
+	// verify that the data is what the pushing peer intended
+	sum, err := fileChecksum(path)
+	if err != nil {
+		log.Println("storeReceived: failed to compute checksum:", err)
+		return
+	}
+	if pm.Checksum != "" && pm.Checksum != sum {
+		log.Println("storeReceived: checksum mismatch, discarding", pm.Identification)
+		c.refusePush(address, pm, reasonCorrupted)
+		return
+	}
+	// control files are only accepted if signed, the previous version is kept otherwise
+	verified, err := c.enc.applySigned(pm.ObjType, pm.Identification, sum, pm.Version, pm.Signer, pm.Signature, func() error {
+		return c.writeReceived(address, path, file, stat.Size(), pm)
+	})
+	if !verified {
+		log.Println("storeReceived: signature verification failed, discarding", pm.Identification+":", err)
+		c.refusePush(address, pm, reasonSignature)
+		return
+	}
+	if err == errQuotaExceeded {
+		log.Println("storeReceived: quota exceeded, discarding", pm.Identification)
+		c.refusePush(address, pm, reasonQuota)
+		return
+	}
+	// this means something failed
 	if err != nil {
-		log.Println("handleRequestMessage: failed to write data to SEDIR:", err)
+		log.Println("storeReceived: writing file failed:", err)
 		return
 	}
+	// record checksum so that the data can be verified when it is retrieved
+	err = c.enc.checksums.set(pm.ObjType, pm.Identification, sum)
+	if err != nil {
+		log.Println("storeReceived: failed to record checksum:", err)
+	}
+	// changed peers must be taken into account for authorization right away
+	if pm.ObjType == shared.OtPeer {
+		c.refreshPeers()
+	}
+}
+
+/*
+writeReceived writes the received file at path, opened as file, to its
+destination according to the push message.
+*/
+func (c *chaninterface) writeReceived(address, path string, file *os.File, size int64, pm *pushMessage) error {
+	// drop the old checksum before replacing the data, if we crash in between the
+	// data is merely unverified instead of wrongly considered corrupted
+	err := c.enc.checksums.remove(pm.ObjType, pm.Identification)
+	if err != nil {
+		return err
+	}
+	// depending on the object type write the file to different locations. Files
+	// on disk are moved into place as they may be sent directly at any time.
+	switch pm.ObjType {
+	case shared.OtModel:
+		// model is not written to storage but to disk directly
+		return replaceFile(c.enc.RootPath+"/"+shared.IDMODEL, path, file)
+	case shared.OtPeer:
+		// peers are written to disk too, but in correct dir with pm.Name
+		peerPath, err := c.enc.peerPath(pm.Identification)
+		if err != nil {
+			return err
+		}
+		return replaceFile(peerPath, path, file)
+	case shared.OtAuth:
+		// auth is also special case
+		return replaceFile(c.enc.RootPath+"/"+shared.ORGDIR+"/"+shared.AUTHJSON, path, file)
+	case shared.OtObject:
+		err = c.enc.quotas.reserve(address, pm.Identification, size)
+		if err != nil {
+			return err
+		}
+		// write to storage
+		err = c.enc.storeObject(pm.Identification, file)
+		if err != nil {
+			c.enc.quotas.cancel(pm.Identification)
+			return err
+		}
+		return c.enc.quotas.commit(pm.Identification)
+	default:
+		return errUnknownType
+	}
+}
+
+/*
+sendFile sends the file at path to the peer under the given name. If the file is
+temporary it is removed once it has been sent successfully. Returns whether the
+transfer was started; once it is done the send scheduler is notified with key.
+*/
+func (c *chaninterface) sendFile(address, key, filePath, name string, temporary bool) bool {
 	// function for when done with transfer
 	onComplete := func(status channel.State) {
+		// in any case free the slot for the next send
+		defer c.sends.done(key)
 		// if NOT success, log and keep file for debugging
 		if status != channel.StSuccess {
-			log.Println("handleRequestMessage: Failed to send file on request!", filePath)
+			log.Println("sendFile: Failed to send file on request!", filePath)
+			return
+		}
+		// files that are not ours to remove are done
+		if !temporary {
 			return
 		}
 		// remove file
 		err := os.Remove(filePath)
 		if err != nil {
-			log.Println("handleRequestMessage: failed to remove temp file:", err)
+			log.Println("sendFile: failed to remove temp file:", err)
 			return
 		}
 	}
-	log.Println("Sending", rm.Identification)
-	// send file
-	err = c.enc.channel.SendFile(address, filePath, rm.Identification, onComplete)
-	// if error log
+	stat, err := os.Stat(filePath)
 	if err != nil {
-		log.Println("handleRequestMessage: SendFile returned error:", err)
+		log.Println("sendFile: failed to stat file:", err)
+		return false
 	}
-}
-
-/*
-handlePushMessage handles the logic upon receiving a PushMessage.
-*/
-func (c *chaninterface) handlePushMessage(address string, pm *shared.PushMessage) {
-	// note that file transfer is allowed for when file is received
-	key := c.buildKey(address, pm.Identification)
-	// if we reach this, allow and store push message too
-	c.mutex.Lock()
-	c.allowedTransfers[key] = *pm
-	c.mutex.Unlock()
-	log.Println("Receiving", pm.Identification)
-	// notify that we have received the push message
-	rm := shared.CreateRequestMessage(pm.ObjType, pm.Identification)
-	c.enc.channel.Send(address, rm.JSON())
+	// send file once pacing allows it
+	c.throttle(address, true, stat.Size(), func() {
+		log.Println("Sending", name)
+		err := c.enc.channel.SendFile(address, filePath, name, onComplete)
+		// if error log and free the slot
+		if err != nil {
+			log.Println("sendFile: SendFile returned error:", err)
+			c.sends.done(key)
+		}
+	})
+	return true
 }
 
 /*
 handleNotifyMessage handles the logic upon receiving a NotifyMessage.
 */
-func (c *chaninterface) handleNotifyMessage(address string, nm *shared.NotifyMessage) {
+func (c *chaninterface) handleNotifyMessage(address string, nm *notifyMessage) {
+	if !validIdentification(nm.Identification) {
+		log.Println("handleNotifyMessage: invalid identification, refusing!")
+		return
+	}
 	switch nm.Notify {
 	case shared.NoRemoved:
-		// notify message must ALSO differentiate types
-		var err error
-		switch nm.ObjType {
-		case shared.OtAuth:
-			err = os.Remove(c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.AUTHJSON)
-		case shared.OtPeer:
-			err = os.Remove(c.enc.RootPath + "/" + shared.ORGDIR + "/" + shared.PEERSDIR + "/" + nm.Identification)
-		default:
-			err = c.enc.storage.Remove(nm.Identification)
+		if !c.enc.permits(address, true, nm.ObjType) {
+			log.Println("handleNotifyMessage: removal not permitted for", address[:8])
+			c.sendForbidden(address, nm.Identification, nm.ObjType)
+			return
+		}
+		// reject removals made under a stale lock
+		if !c.enc.checkToken(address, nm.Token) {
+			log.Println("handleNotifyMessage: stale fencing token, refusing removal of", nm.Identification)
+			c.enc.sendLockStatus(address, statusUnlocked, grant{})
+			return
+		}
+		// removing control files must be signed too
+		verified, err := c.enc.applySigned(nm.ObjType, nm.Identification, "", nm.Version, nm.Signer, nm.Signature, func() error {
+			return c.enc.removeNotified(nm)
+		})
+		if !verified {
+			log.Println("handleNotifyMessage: signature verification failed, refusing removal of", nm.Identification+":", err)
+			reply := createRefusal(nm.Identification, nm.ObjType, reasonSignature)
+			c.enc.channel.Send(address, reply.JSON())
+			return
 		}
 		// if error log
 		if err != nil {
 			log.Println("handleNotifyMessage: failed to remove type", nm.ObjType.String(), "since:", err)
+			return
+		}
+		err = c.enc.checksums.remove(nm.ObjType, nm.Identification)
+		if err != nil {
+			log.Println("handleNotifyMessage: failed to remove checksum:", err)
+		}
+		if nm.ObjType == shared.OtPeer {
+			c.refreshPeers()
 		}
 	default:
 		log.Println("handleNotifyMessage: unknown notify type:", nm.Notify)
 	}
 }
 
+/*
+removeNotified removes the object given in the removal notify.
+*/
+func (enc *Encrypted) removeNotified(nm *notifyMessage) error {
+	// notify message must ALSO differentiate types
+	switch nm.ObjType {
+	case shared.OtAuth:
+		return os.Remove(enc.RootPath + "/" + shared.ORGDIR + "/" + shared.AUTHJSON)
+	case shared.OtPeer:
+		peerPath, err := enc.peerPath(nm.Identification)
+		if err != nil {
+			return err
+		}
+		return os.Remove(peerPath)
+	default:
+		return enc.removeObject(nm.Identification)
+	}
+}
+
+/*
+refreshPeers reloads the peers used for authorization, logging any failure.
+*/
+func (c *chaninterface) refreshPeers() {
+	err := c.enc.refreshPeers()
+	if err != nil {
+		log.Println("refreshPeers: failed to load peers:", err)
+	}
+}
+
+/*
+refusePush notifies the peer that its pushed object was not accepted and why.
+*/
+func (c *chaninterface) refusePush(address string, pm *pushMessage, reason string) {
+	nm := createRefusal(pm.Identification, pm.ObjType, reason)
+	c.enc.channel.Send(address, nm.JSON())
+}
+
+/*
+sendForbidden notifies the peer that its role does not allow the operation on
+the given object.
+*/
+func (c *chaninterface) sendForbidden(address, identification string, objType shared.ObjectType) {
+	nm := createRefusal(identification, objType, reasonForbidden)
+	c.enc.channel.Send(address, nm.JSON())
+}
+
+/*
+removeAllowance removes the allowance of the transfer with the given key and
+frees its receive slot.
+*/
+func (c *chaninterface) removeAllowance(key string) {
+	c.mutex.Lock()
+	delete(c.allowedTransfers, key)
+	delete(c.moving, key)
+	c.mutex.Unlock()
+	c.receives.done(key)
+	c.enc.persistLock()
+}
+
+/*
+dropAllowances removes all allowances of the given address, including those
+whose data is being received, and frees their receive slots.
+*/
+func (c *chaninterface) dropAllowances(address string) {
+	prefix := c.buildKey(address, "")
+	var keys []string
+	c.mutex.Lock()
+	for key := range c.allowedTransfers {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	c.mutex.Unlock()
+	for _, key := range keys {
+		c.removeAllowance(key)
+	}
+}
+
 /*
 buildKey is a helper function that builds the key used to identify transfers.
 */
 func (c *chaninterface) buildKey(address, identification string) string {
 	return address + ":" + identification
 }
+
+/*
+writeStream writes all data read from the reader to the file at path, creating
+or truncating it.
+*/
+func writeStream(path string, reader io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+writeFileAtomic writes data to the file at path. The data is written to a temp
+file next to it which is synced and then renamed into place, so that the file
+always holds either the previous or the new data.
+*/
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Chmod(shared.FILEPERMISSIONMODE)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+/*
+replaceFile atomically replaces the file at destination with the received file
+at path. If it can't be moved the data is copied from reader instead.
+*/
+func replaceFile(destination, path string, reader io.Reader) error {
+	err := os.Rename(path, destination)
+	if err == nil {
+		return nil
+	}
+	// fall back to copying via a temp file next to the destination
+	err = writeStream(destination+".tmp", reader)
+	if err != nil {
+		os.Remove(destination + ".tmp")
+		return err
+	}
+	return os.Rename(destination+".tmp", destination)
+}
@@ -36,10 +36,21 @@ func Create(path, peerName string, storage Storage) (*Encrypted, error) {
 	}()
 	// build
 	encrypted := &Encrypted{
-		RootPath: path, // rootPath for storing root
-		storage:  storage}
+		RootPath:  path, // rootPath for storing root
+		storage:   storage,
+		checksums: createChecksumStore(path + "/" + shared.LOCALDIR + "/" + checksumDir),
+		quotas:    createQuotas(path + "/" + shared.LOCALDIR),
+		peers:     createPeerList(),
+		scrubber:  createScrubber(),
+		lock:      createLocker()}
 	// prepare chaninterface
 	encrypted.cInterface = createChanInterface(encrypted)
+	// the storage may already hold objects that must count for quotas
+	err = encrypted.loadQuotas()
+	if err != nil {
+		failed = true
+		return nil, err
+	}
 	// build channel
 	channel, err := channel.Create(peerName, nil, encrypted.cInterface)
 	if err != nil {
@@ -84,10 +95,30 @@ func Load(path string, storage Storage) (*Encrypted, error) {
 	}
 	// build structure
 	encrypted := &Encrypted{
-		RootPath: path,
-		storage:  storage}
+		RootPath:  path,
+		storage:   storage,
+		checksums: createChecksumStore(path + "/" + shared.LOCALDIR + "/" + checksumDir),
+		quotas:    createQuotas(path + "/" + shared.LOCALDIR),
+		peers:     createPeerList(),
+		scrubber:  createScrubber(),
+		lock:      createLocker()}
 	// prepare interface
 	encrypted.cInterface = createChanInterface(encrypted)
+	// restore lock and pending transfers so that an interrupted sync can continue
+	err := encrypted.loadLockState()
+	if err != nil {
+		return nil, err
+	}
+	// restore usage so that quotas keep applying
+	err = encrypted.loadQuotas()
+	if err != nil {
+		return nil, err
+	}
+	// remove what crashed or failed transfers left behind
+	_, err = encrypted.CleanTemporary(tempRetention)
+	if err != nil {
+		return nil, err
+	}
 	// load data
 	selfPeer, err := shared.LoadToxDumpFrom(path + "/" + shared.LOCALDIR)
 	if err != nil {
@@ -95,6 +126,15 @@ func Load(path string, storage Storage) (*Encrypted, error) {
 	}
 	// set self peer
 	encrypted.Peer = selfPeer.SelfPeer
+	// load revoked and trusted peers so that messages can be authorized right away
+	err = encrypted.loadRevoked()
+	if err != nil {
+		return nil, err
+	}
+	err = encrypted.refreshPeers()
+	if err != nil {
+		return nil, err
+	}
 	// build channel
 	encrypted.channel, err = channel.Create(encrypted.Peer.Name, selfPeer.ToxData, encrypted.cInterface)
 	if err != nil {
@@ -0,0 +1,61 @@
+package encrypted
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Identifications and names supplied by peers end up in file paths. Every handler
+checks them with validIdentification before using them, and paths below a
+directory are built with safePath which additionally ensures that the result
+stays within that directory.
+*/
+
+/*
+validIdentification returns whether an identification supplied by a peer may be
+used. Apart from being a valid file name it may not contain the chunk separator
+and must be short enough to still be a valid file name once turned into a
+transfer key.
+*/
+func validIdentification(identification string) bool {
+	if len(identification) > maxIdentificationLength {
+		return false
+	}
+	if strings.Contains(identification, chunkSeparator) {
+		return false
+	}
+	return validKey(identification)
+}
+
+/*
+safePath returns the path of name within dir. Returns an error if name is not a
+plain file name, so that the path can never point outside of dir.
+*/
+func safePath(dir, name string) (string, error) {
+	if !validKey(name) {
+		return "", errInvalidIdentification
+	}
+	path := filepath.Join(dir, name)
+	if filepath.Dir(path) != filepath.Clean(dir) {
+		return "", errInvalidIdentification
+	}
+	return path, nil
+}
+
+/*
+peerPath returns the path of the peer file with the given identification.
+*/
+func (enc *Encrypted) peerPath(identification string) (string, error) {
+	return safePath(enc.RootPath+"/"+shared.ORGDIR+"/"+shared.PEERSDIR, identification)
+}
+
+/*
+transferPath returns the path of the temporary file of a transfer with the
+given peer in dir, which is either SENDINGDIR or RECEIVINGDIR.
+*/
+func (c *chaninterface) transferPath(dir, address, name string) (string, error) {
+	return safePath(c.enc.RootPath+"/"+dir, c.buildKey(address, name))
+}
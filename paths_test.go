@@ -0,0 +1,132 @@
+package encrypted
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+hostileNames are identifications a peer could use to escape the directories
+they end up in or to clash with internal names.
+*/
+var hostileNames = []string{
+	"",
+	".",
+	"..",
+	"../x",
+	"../../etc/passwd",
+	"a/b",
+	"/abs",
+	`a\b`,
+	`..\x`,
+	".hidden",
+	"a\x00b",
+	"a" + chunkSeparator + "0",
+	strings.Repeat("a", maxIdentificationLength+1),
+}
+
+func TestValidIdentification(t *testing.T) {
+	for _, name := range hostileNames {
+		if validIdentification(name) {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+	valid := []string{"a", "a.b", "a..b", "peer-1", strings.Repeat("a", maxIdentificationLength)}
+	for _, name := range valid {
+		if !validIdentification(name) {
+			t.Errorf("expected %q to be valid", name)
+		}
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../x", false},
+		{"a/b", false},
+		{"a/../b", false},
+		{`a\b`, false},
+		{".hidden", false},
+		{"a\x00b", false},
+		{"a", true},
+		{"a..b", true},
+		// chunk names are valid below a directory, only identifications can't hold them
+		{"a" + chunkSeparator + "0", true},
+	}
+	for _, c := range cases {
+		path, err := safePath(dir, c.name)
+		if !c.valid {
+			if err != errInvalidIdentification {
+				t.Errorf("safePath(%q): expected errInvalidIdentification, got %q, %v", c.name, path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("safePath(%q): unexpected error %v", c.name, err)
+			continue
+		}
+		if path != filepath.Join(dir, c.name) || filepath.Dir(path) != filepath.Clean(dir) {
+			t.Errorf("safePath(%q): expected path within %s, got %s", c.name, dir, path)
+		}
+	}
+}
+
+func TestHandlersRefuseHostileNames(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	// a file next to the peers directory that must never be served as a peer
+	secret := filepath.Join(enc.RootPath, shared.ORGDIR, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	names := append(hostileNames, "../secret", `..\secret`)
+	for _, name := range names {
+		for _, objType := range []shared.ObjectType{shared.OtObject, shared.OtPeer} {
+			pm := pushMessage{PushMessage: shared.CreatePushMessage(name, objType)}
+			c.OnMessage(testAddress, pm.JSON())
+			rm := requestMessage{RequestMessage: shared.CreateRequestMessage(objType, name)}
+			c.OnMessage(testAddress, rm.JSON())
+			nm := notifyMessage{NotifyMessage: shared.CreateNotifyMessage(shared.NoRemoved, name, objType)}
+			c.OnMessage(testAddress, nm.JSON())
+		}
+		if allowed, path := c.OnAllowFile(testAddress, name); allowed || path != "" {
+			t.Errorf("OnAllowFile(%q): expected refusal, got %v, %q", name, allowed, path)
+		}
+		if sent := fakeOf(enc).filesSent(testAddress); len(sent) != 0 {
+			t.Fatalf("request for %q was served: %v", name, sent)
+		}
+	}
+	if len(c.allowedTransfers) != 0 {
+		t.Errorf("expected no allowed transfers, got %v", c.allowedTransfers)
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("expected file outside of peers to be kept: %v", err)
+	}
+	// sanity check that valid names pass the same handlers
+	peer := filepath.Join(enc.RootPath, shared.ORGDIR, shared.PEERSDIR, "peer")
+	if err := ioutil.WriteFile(peer, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rm := requestMessage{RequestMessage: shared.CreateRequestMessage(shared.OtPeer, "peer")}
+	c.OnMessage(testAddress, rm.JSON())
+	if sent := fakeOf(enc).filesSent(testAddress); len(sent) != 1 || sent[0] != "peer" {
+		t.Errorf("expected request for valid peer to be served, sent %v", sent)
+	}
+	pm := pushMessage{PushMessage: shared.CreatePushMessage("object", shared.OtObject)}
+	c.OnMessage(testAddress, pm.JSON())
+	allowed, path := c.OnAllowFile(testAddress, "object")
+	if !allowed || filepath.Dir(path) != filepath.Join(enc.RootPath, shared.RECEIVINGDIR) {
+		t.Errorf("expected push of valid object to be allowed, got %v, %q", allowed, path)
+	}
+}
@@ -0,0 +1,127 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Role defines what a trusted peer may do with encrypted. Roles are assigned per
+address in the permissionsJSON file within ORGDIR, next to the peer files.
+Trusted peers without an assigned role are admins.
+*/
+type Role string
+
+/*
+Available roles, each including the rights of the previous ones.
+*/
+const (
+	RoleRead    Role = "read"    // may only take the shared lock and request data
+	RoleObjects Role = "objects" // may also push and remove objects
+	RoleWrite   Role = "write"   // may also replace the model and the auth file
+	RoleAdmin   Role = "admin"   // may also change the peer list
+)
+
+/*
+roleRanks orders the roles. Unknown roles have no rights at all.
+*/
+var roleRanks = map[Role]int{
+	RoleRead:    1,
+	RoleObjects: 2,
+	RoleWrite:   3,
+	RoleAdmin:   4}
+
+/*
+includes returns whether the role has all rights of the other role.
+*/
+func (r Role) includes(other Role) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[other]
+}
+
+/*
+requiredRole returns the role required to access objects of the given type.
+Reading requires RoleRead for all types.
+*/
+func requiredRole(write bool, objType shared.ObjectType) Role {
+	if !write {
+		return RoleRead
+	}
+	switch objType {
+	case shared.OtObject:
+		return RoleObjects
+	case shared.OtModel, shared.OtAuth:
+		return RoleWrite
+	default:
+		return RoleAdmin
+	}
+}
+
+/*
+SetRole assigns the role to the peer with the given address. An empty role
+removes the assignment so that the peer is an admin again.
+*/
+func (enc *Encrypted) SetRole(address string, role Role) error {
+	if role != "" && roleRanks[role] == 0 {
+		return shared.ErrIllegalParameters
+	}
+	roles, err := enc.loadRoles()
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		delete(roles, address)
+	} else {
+		roles[address] = role
+	}
+	data, err := json.MarshalIndent(roles, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := enc.RootPath + "/" + shared.ORGDIR + "/" + permissionsJSON
+	err = writeFileAtomic(path, data)
+	if err != nil {
+		return err
+	}
+	return enc.refreshPeers()
+}
+
+/*
+roleOf returns the role of the peer with the given address. Peers that are not
+authorized have no role.
+*/
+func (enc *Encrypted) roleOf(address string) Role {
+	if !enc.isAuthorized(address) {
+		return ""
+	}
+	return enc.peers.role(address)
+}
+
+/*
+permits returns whether the peer may read or write objects of the given type.
+*/
+func (enc *Encrypted) permits(address string, write bool, objType shared.ObjectType) bool {
+	return enc.roleOf(address).includes(requiredRole(write, objType))
+}
+
+/*
+loadRoles reads the assigned roles from ORGDIR. A missing file means that no
+roles have been assigned.
+*/
+func (enc *Encrypted) loadRoles() (map[string]Role, error) {
+	roles := make(map[string]Role)
+	data, err := ioutil.ReadFile(enc.RootPath + "/" + shared.ORGDIR + "/" + permissionsJSON)
+	if os.IsNotExist(err) {
+		return roles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &roles)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
@@ -0,0 +1,105 @@
+package encrypted
+
+import (
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+forbidden returns whether a refusal for the identification has been sent to the
+address because its role doesn't allow the operation.
+*/
+func forbidden(enc *Encrypted, address, identification string) bool {
+	for _, nm := range fakeOf(enc).notifies(address) {
+		if nm.Identification == identification && nm.Reason == reasonForbidden {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoleLockMode(t *testing.T) {
+	enc := createTestEncrypted(t)
+	enc.releaseLock(testAddress)
+	enc.peers.setRoles(map[string]Role{testAddress: RoleRead})
+	// readers asking for the exclusive lock only receive the shared one
+	lm := lockMessage{LockMessage: shared.CreateLockMessage(shared.LoRequest), Mode: modeWrite}
+	enc.cInterface.OnMessage(testAddress, lm.JSON())
+	replies := fakeOf(enc).lockReplies(testAddress)
+	if len(replies) == 0 || replies[len(replies)-1].Status != statusGranted || replies[len(replies)-1].Mode != modeRead {
+		t.Fatalf("expected shared lock to be granted, got %v", replies)
+	}
+	if enc.lock.holds(testAddress, true) {
+		t.Error("reader holds the exclusive lock")
+	}
+}
+
+func TestRolePush(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     Role
+		objType  shared.ObjectType
+		expected bool // whether the push is allowed
+	}{
+		{"reader pushing object", RoleRead, shared.OtObject, false},
+		{"objects pushing object", RoleObjects, shared.OtObject, true},
+		{"objects pushing model", RoleObjects, shared.OtModel, false},
+		{"write pushing model", RoleWrite, shared.OtModel, true},
+		{"write pushing peer", RoleWrite, shared.OtPeer, false},
+		{"admin pushing peer", RoleAdmin, shared.OtPeer, true},
+	}
+	for _, test := range tests {
+		enc := createTestEncrypted(t)
+		c := enc.cInterface
+		enc.peers.setRoles(map[string]Role{testAddress: test.role})
+		pm := pushMessage{PushMessage: shared.CreatePushMessage("id", test.objType)}
+		c.OnMessage(testAddress, pm.JSON())
+		c.mutex.Lock()
+		_, allowed := c.allowedTransfers[c.buildKey(testAddress, "id")]
+		c.mutex.Unlock()
+		if allowed != test.expected {
+			t.Errorf("%s: expected allowed to be %v, got %v", test.name, test.expected, allowed)
+		}
+		if forbidden(enc, testAddress, "id") == test.expected {
+			t.Errorf("%s: expected forbidden to be %v", test.name, !test.expected)
+		}
+	}
+}
+
+func TestRoleChangedBeforeFile(t *testing.T) {
+	enc := createTestEncrypted(t)
+	c := enc.cInterface
+	pm := pushMessage{PushMessage: shared.CreatePushMessage("object", shared.OtObject)}
+	c.OnMessage(testAddress, pm.JSON())
+	// the role is lowered after the push was allowed but before the data arrives
+	enc.peers.setRoles(map[string]Role{testAddress: RoleRead})
+	if allowed, _ := c.OnAllowFile(testAddress, "object"); allowed {
+		t.Error("expected file to be refused after role change")
+	}
+	if !forbidden(enc, testAddress, "object") {
+		t.Error("expected forbidden refusal")
+	}
+}
+
+func TestRoleRemoval(t *testing.T) {
+	enc := createTestEncrypted(t)
+	if err := enc.storage.Store("object", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	enc.peers.setRoles(map[string]Role{testAddress: RoleRead})
+	nm := createNotifyMessage(shared.NoRemoved, "object", shared.OtObject, "")
+	enc.cInterface.OnMessage(testAddress, nm.JSON())
+	if !forbidden(enc, testAddress, "object") {
+		t.Error("expected removal to be forbidden")
+	}
+	if _, err := enc.storage.Retrieve("object"); err != nil {
+		t.Error("expected object to be kept:", err)
+	}
+	// peers that may write objects can remove them
+	enc.peers.setRoles(map[string]Role{testAddress: RoleObjects})
+	enc.cInterface.OnMessage(testAddress, nm.JSON())
+	if _, err := enc.storage.Retrieve("object"); err == nil {
+		t.Error("expected object to be removed")
+	}
+}
@@ -0,0 +1,200 @@
+package encrypted
+
+import (
+	"encoding/json"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+The messages here extend the shared messages with optional fields. Peers that
+don't know about them simply leave them empty and are handled as before.
+*/
+
+/*
+noRefused is the notify type of refusals, which always carry a reason. It is not
+one of the shared notify types so that peers that don't know it ignore refusals
+instead of mistaking them for missing or removed objects.
+*/
+const noRefused shared.NotifyType = 100
+
+/*
+Reasons that can be given in a notifyMessage. A refusal carries any of them,
+NoMissing only reasonCorrupted for stored data that can't be served.
+*/
+const (
+	reasonCorrupted = "corrupted" // stored data failed verification
+	reasonQuota     = "quota"     // storing the object would exceed a quota
+	reasonTooLarge  = "toolarge"  // the object exceeds the maximum size of its type
+	reasonForbidden = "forbidden" // the role of the peer does not allow the operation
+	reasonSignature = "signature" // the change to a control file is not signed correctly
+)
+
+/*
+Lock modes that can be given in a lockMessage. Peers that don't specify one
+request the exclusive lock.
+*/
+const (
+	modeRead  = "read"  // shared lock, only allows requests
+	modeWrite = "write" // exclusive lock, allows all operations
+)
+
+/*
+Lock statuses sent in replies to peers. A granted lock is sent with LoAccept,
+all others with LoRelease so that peers that don't read the status still know
+that they don't hold the lock.
+*/
+const (
+	statusGranted  = "granted"  // the lock was granted
+	statusDenied   = "denied"   // the lock is busy, the peer has been queued and will be granted the lock later
+	statusReleased = "released" // the lock was released or the peer left the queue
+	statusExpired  = "expired"  // the lock timed out
+	statusUnlocked = "unlocked" // the peer tried an operation without holding a valid lock
+)
+
+/*
+lockMessage is a shared.LockMessage with optional extensions.
+*/
+type lockMessage struct {
+	shared.LockMessage
+	Token  uint64 `json:"token,omitempty"`  // fencing token of a granted lock
+	Mode   string `json:"mode,omitempty"`   // requested or granted lock mode
+	Status string `json:"status,omitempty"` // status of the lock for replies
+}
+
+/*
+createLockReply returns a lockMessage with the given status. If the status is
+statusGranted the grant is included.
+*/
+func createLockReply(status string, granted grant) lockMessage {
+	if status != statusGranted {
+		return lockMessage{
+			LockMessage: shared.CreateLockMessage(shared.LoRelease),
+			Status:      status}
+	}
+	return lockMessage{
+		LockMessage: shared.CreateLockMessage(shared.LoAccept),
+		Token:       granted.token,
+		Mode:        modeOf(granted.read),
+		Status:      status}
+}
+
+/*
+JSON returns the JSON representation of the message.
+*/
+func (lm *lockMessage) JSON() string {
+	data, _ := json.Marshal(lm)
+	return string(data)
+}
+
+/*
+pushMessage is a shared.PushMessage with optional extensions. If Chunks is set
+the object is transferred in chunks of ChunkSize bytes, see chunk.go.
+*/
+type pushMessage struct {
+	shared.PushMessage
+	Checksum  string   `json:"checksum,omitempty"`  // hex encoded SHA-256 of the object
+	Token     uint64   `json:"token,omitempty"`     // fencing token of the lock the push is made under
+	Size      int64    `json:"size,omitempty"`      // size of the object in bytes
+	ChunkSize int64    `json:"chunksize,omitempty"` // size of a single chunk in bytes
+	Chunks    []string `json:"chunks,omitempty"`    // hex encoded SHA-256 of every chunk in order
+	Version   uint64   `json:"version,omitempty"`   // version of a signed object, see signature.go
+	Signer    string   `json:"signer,omitempty"`    // address of the peer that signed the object
+	Signature string   `json:"signature,omitempty"` // hex encoded signature of the object
+}
+
+/*
+JSON returns the JSON representation of the message.
+*/
+func (pm *pushMessage) JSON() string {
+	data, _ := json.Marshal(pm)
+	return string(data)
+}
+
+/*
+expectedSize returns the size of the pushed object as far as it is known in
+advance. For chunked pushes without a size the upper bound is returned.
+*/
+func (pm *pushMessage) expectedSize() int64 {
+	if pm.Size == 0 && pm.isChunked() {
+		return int64(len(pm.Chunks)) * pm.ChunkSize
+	}
+	return pm.Size
+}
+
+/*
+requestMessage is a shared.RequestMessage with optional extensions. If
+ChunkSize is set only the given chunk of the object is requested. When sent as
+the reply to a push MaxSize advertises the largest object accepted.
+*/
+type requestMessage struct {
+	shared.RequestMessage
+	Chunk     int   `json:"chunk,omitempty"`     // number of the requested chunk, starting at zero
+	ChunkSize int64 `json:"chunksize,omitempty"` // size of a single chunk in bytes
+	MaxSize   int64 `json:"maxsize,omitempty"`   // maximum accepted object size in bytes
+}
+
+/*
+createChunkRequest returns a requestMessage for the given chunk.
+*/
+func createChunkRequest(objType shared.ObjectType, identification string, chunk int, chunkSize int64) requestMessage {
+	return requestMessage{
+		RequestMessage: shared.CreateRequestMessage(objType, identification),
+		Chunk:          chunk,
+		ChunkSize:      chunkSize}
+}
+
+/*
+JSON returns the JSON representation of the message.
+*/
+func (rm *requestMessage) JSON() string {
+	data, _ := json.Marshal(rm)
+	return string(data)
+}
+
+/*
+notifyMessage is a shared.NotifyMessage with optional extensions.
+*/
+type notifyMessage struct {
+	shared.NotifyMessage
+	Reason    string `json:"reason,omitempty"`    // why the notify was sent
+	Token     uint64 `json:"token,omitempty"`     // fencing token of the lock the notify is sent under
+	Version   uint64 `json:"version,omitempty"`   // version of a signed removal, see signature.go
+	Signer    string `json:"signer,omitempty"`    // address of the peer that signed a removal
+	Signature string `json:"signature,omitempty"` // hex encoded signature of a removal
+}
+
+/*
+createNotifyMessage returns a notifyMessage with the given reason.
+*/
+func createNotifyMessage(notify shared.NotifyType, identification string, objType shared.ObjectType, reason string) notifyMessage {
+	return notifyMessage{
+		NotifyMessage: shared.CreateNotifyMessage(notify, identification, objType),
+		Reason:        reason}
+}
+
+/*
+createRefusal returns a notifyMessage refusing the operation on the given object
+for the given reason.
+*/
+func createRefusal(identification string, objType shared.ObjectType, reason string) notifyMessage {
+	return createNotifyMessage(noRefused, identification, objType, reason)
+}
+
+/*
+JSON returns the JSON representation of the message.
+*/
+func (nm *notifyMessage) JSON() string {
+	data, _ := json.Marshal(nm)
+	return string(data)
+}
+
+/*
+modeOf returns the lock mode for the given flag.
+*/
+func modeOf(read bool) string {
+	if read {
+		return modeRead
+	}
+	return modeWrite
+}
@@ -0,0 +1,393 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Quota is an amount of stored objects. It is used both for limits, where zero
+fields mean no limit, and for reporting usage.
+*/
+type Quota struct {
+	Bytes   int64 `json:"bytes"`   // total size of the objects
+	Objects int   `json:"objects"` // number of objects
+}
+
+/*
+exceeds returns whether the usage lies beyond the quota.
+*/
+func (q Quota) exceeds(usage Quota) bool {
+	return (q.Bytes > 0 && usage.Bytes > q.Bytes) || (q.Objects > 0 && usage.Objects > q.Objects)
+}
+
+/*
+quotaState is the persisted usage, in total and per pushing peer.
+*/
+type quotaState struct {
+	Total Quota            `json:"total"`
+	Peers map[string]Quota `json:"peers"`
+}
+
+/*
+owner records which peer pushed an object and how large it was, so that the
+usage can be released again when the object is replaced or removed.
+*/
+type owner struct {
+	Address string `json:"address"`
+	Size    int64  `json:"size"`
+}
+
+/*
+quotas tracks the usage of the storage by received objects and enforces the
+configured limits. The usage is written to quotaJSON, the owner of every object
+to its own file in ownerDir, both within dir. Objects that were stored before
+usage was tracked are counted without an owner, see seed.
+*/
+type quotas struct {
+	mutex    sync.Mutex
+	dir      string                      // directory the usage is persisted to
+	total    Quota                       // limit for all objects
+	perPeer  Quota                       // limit for the objects pushed by a single peer
+	maxSizes map[shared.ObjectType]int64 // maximum size of a single object per type
+	usage    quotaState                  // current usage, including reservations
+	pending  map[string]owner            // reservations of objects being stored
+}
+
+/*
+createQuotas returns quotas without limits persisting to the given directory.
+*/
+func createQuotas(dir string) *quotas {
+	return &quotas{
+		dir:      dir,
+		maxSizes: make(map[shared.ObjectType]int64),
+		usage:    quotaState{Peers: make(map[string]Quota)},
+		pending:  make(map[string]owner)}
+}
+
+/*
+SetQuota sets the limits for all stored objects and for the objects pushed by
+each single peer. Zero fields mean no limit. Pushes that would exceed a limit
+are refused.
+*/
+func (enc *Encrypted) SetQuota(total, perPeer Quota) {
+	enc.quotas.mutex.Lock()
+	defer enc.quotas.mutex.Unlock()
+	enc.quotas.total = total
+	enc.quotas.perPeer = perPeer
+}
+
+/*
+QuotaUsage returns the usage of all stored objects and of the objects pushed by
+each peer.
+*/
+func (enc *Encrypted) QuotaUsage() (Quota, map[string]Quota) {
+	enc.quotas.mutex.Lock()
+	defer enc.quotas.mutex.Unlock()
+	peers := make(map[string]Quota)
+	for address, usage := range enc.quotas.usage.Peers {
+		peers[address] = usage
+	}
+	return enc.quotas.usage.Total, peers
+}
+
+/*
+SetMaxSize sets the maximum size in bytes of a single received object of the
+given type. Zero means no limit. The limit is advertised to pushing peers and
+larger transfers are refused, as are unchunked pushes that don't advertise their
+size.
+*/
+func (enc *Encrypted) SetMaxSize(objType shared.ObjectType, size int64) {
+	enc.quotas.mutex.Lock()
+	defer enc.quotas.mutex.Unlock()
+	enc.quotas.maxSizes[objType] = size
+}
+
+/*
+maxSize returns the maximum size of a single object of the given type, zero if
+there is no limit.
+*/
+func (q *quotas) maxSize(objType shared.ObjectType) int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.maxSizes[objType]
+}
+
+/*
+fits returns whether an object of the given type and size is within the
+maximum size.
+*/
+func (q *quotas) fits(objType shared.ObjectType, size int64) bool {
+	max := q.maxSize(objType)
+	return max <= 0 || size <= max
+}
+
+/*
+allows returns whether the peer may store an object of the given size under key
+without exceeding any limit. An object replaced by it is taken into account.
+Reservations of objects that are being stored count as used.
+*/
+func (q *quotas) allows(address, key string, size int64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, err := q.change(address, key, size)
+	return err == nil
+}
+
+/*
+reserve accounts the object of the given size that is about to be stored under
+key to the peer if no limit is exceeded. Checking and accounting happen at once
+so that concurrent pushes can't exceed a limit together. The reservation must
+be followed by either commit or cancel.
+*/
+func (q *quotas) reserve(address, key string, size int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, exists := q.pending[key]; exists {
+		return errReserved
+	}
+	usage, err := q.change(address, key, size)
+	if err != nil {
+		return err
+	}
+	q.usage = usage
+	q.pending[key] = owner{Address: address, Size: size}
+	return nil
+}
+
+/*
+commit records the owner of the object reserved under key once it has been
+stored and persists the usage.
+*/
+func (q *quotas) commit(key string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	reserved, exists := q.pending[key]
+	if !exists {
+		return nil
+	}
+	delete(q.pending, key)
+	err := q.setOwner(key, &reserved)
+	if err != nil {
+		return err
+	}
+	return q.store()
+}
+
+/*
+cancel reverts the reservation of key if the object could not be stored.
+*/
+func (q *quotas) cancel(key string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	reserved, exists := q.pending[key]
+	if !exists {
+		return
+	}
+	delete(q.pending, key)
+	q.usage.apply(reserved.Address, -reserved.Size, -1)
+	// the replaced object is still there
+	if previous, err := q.owner(key); err == nil && previous != nil {
+		q.usage.apply(previous.Address, previous.Size, 1)
+	}
+}
+
+/*
+release frees the usage of the object stored under key. Objects without a
+recorded owner are ignored.
+*/
+func (q *quotas) release(key string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	previous, err := q.owner(key)
+	if err != nil || previous == nil {
+		return err
+	}
+	q.usage.apply(previous.Address, -previous.Size, -1)
+	path, err := q.ownerPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return q.store()
+}
+
+/*
+change returns the usage after storing an object of the given size under key
+for the peer, replacing any previous object of the same key. Returns
+errQuotaExceeded if a limit would be exceeded. NOTE: the mutex must be held when
+calling this.
+*/
+func (q *quotas) change(address, key string, size int64) (quotaState, error) {
+	usage := quotaState{
+		Total: q.usage.Total,
+		Peers: make(map[string]Quota)}
+	for peer, used := range q.usage.Peers {
+		usage.Peers[peer] = used
+	}
+	previous, err := q.owner(key)
+	if err != nil {
+		return usage, err
+	}
+	if previous != nil {
+		usage.apply(previous.Address, -previous.Size, -1)
+	}
+	usage.apply(address, size, 1)
+	if q.total.exceeds(usage.Total) || q.perPeer.exceeds(usage.Peers[address]) {
+		return usage, errQuotaExceeded
+	}
+	return usage, nil
+}
+
+/*
+setOwner writes the owner of the object stored under key. NOTE: the mutex must
+be held when calling this.
+*/
+func (q *quotas) setOwner(key string, o *owner) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(q.dir+"/"+ownerDir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	path, err := q.ownerPath(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+/*
+owner returns the recorded owner of the object stored under key, or nil if none
+has been recorded. NOTE: the mutex must be held when calling this.
+*/
+func (q *quotas) owner(key string) (*owner, error) {
+	path, err := q.ownerPath(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	previous := &owner{}
+	err = json.Unmarshal(data, previous)
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+/*
+ownerPath returns the file the owner of the object stored under key is written
+to.
+*/
+func (q *quotas) ownerPath(key string) (string, error) {
+	return safePath(q.dir+"/"+ownerDir, key)
+}
+
+/*
+store writes the usage to disk. NOTE: the mutex must be held when calling this.
+*/
+func (q *quotas) store() error {
+	data, err := json.MarshalIndent(&q.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := q.dir + "/" + quotaJSON
+	return writeFileAtomic(path, data)
+}
+
+/*
+loadQuotas restores the usage from disk. If it has never been stored the usage
+is seeded from the objects already in storage.
+*/
+func (enc *Encrypted) loadQuotas() error {
+	exists, err := enc.quotas.load()
+	if err != nil || exists {
+		return err
+	}
+	err = enc.quotas.seed(enc.walkStorage)
+	if err == ErrNoLister {
+		enc.warn("Storage can't be listed, existing objects are not counted for quotas.")
+		return nil
+	}
+	return err
+}
+
+/*
+seed counts all objects listed by walk as used without an owner and stores the
+usage.
+*/
+func (q *quotas) seed(walk func(func(KeyInfo) error) error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	usage := quotaState{Peers: make(map[string]Quota)}
+	err := walk(func(info KeyInfo) error {
+		usage.apply("", info.Size, 1)
+		// record the size so that the usage is freed once the object is removed
+		return q.setOwner(info.Key, &owner{Size: info.Size})
+	})
+	if err != nil {
+		return err
+	}
+	q.usage = usage
+	return q.store()
+}
+
+/*
+load reads the usage from disk. Returns whether it had been stored before.
+*/
+func (q *quotas) load() (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	data, err := ioutil.ReadFile(q.dir + "/" + quotaJSON)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	usage := quotaState{}
+	err = json.Unmarshal(data, &usage)
+	if err != nil {
+		return false, err
+	}
+	if usage.Peers == nil {
+		usage.Peers = make(map[string]Quota)
+	}
+	q.usage = usage
+	return true, nil
+}
+
+/*
+apply changes the usage of the total and the given peer. Objects without an
+owner only count for the total.
+*/
+func (qs *quotaState) apply(address string, size int64, objects int) {
+	qs.Total.Bytes += size
+	qs.Total.Objects += objects
+	if address == "" {
+		return
+	}
+	peer := qs.Peers[address]
+	peer.Bytes += size
+	peer.Objects += objects
+	if peer.Objects <= 0 {
+		delete(qs.Peers, address)
+		return
+	}
+	qs.Peers[address] = peer
+}
@@ -0,0 +1,170 @@
+package encrypted
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestQuotasAllows(t *testing.T) {
+	cases := []struct {
+		name    string
+		total   Quota
+		perPeer Quota
+		address string
+		key     string
+		size    int64
+		allowed bool
+	}{
+		{"no limits", Quota{}, Quota{}, "a", "new", 1 << 40, true},
+		{"within total", Quota{Bytes: 100}, Quota{}, "a", "new", 50, true},
+		{"beyond total bytes", Quota{Bytes: 100}, Quota{}, "a", "new", 61, false},
+		{"beyond total objects", Quota{Objects: 1}, Quota{}, "b", "new", 1, false},
+		{"within peer", Quota{}, Quota{Bytes: 50}, "b", "new", 50, true},
+		{"beyond peer bytes", Quota{}, Quota{Bytes: 50}, "a", "new", 11, false},
+		{"beyond peer objects", Quota{}, Quota{Objects: 1}, "a", "new", 1, false},
+		{"replacing own object", Quota{Bytes: 100}, Quota{Bytes: 40}, "a", "old", 40, true},
+		{"replacing grows beyond", Quota{Bytes: 100}, Quota{}, "a", "old", 101, false},
+		{"replacing other peer's object", Quota{}, Quota{Bytes: 40}, "b", "old", 40, true},
+	}
+	for _, c := range cases {
+		q := createQuotas(t.TempDir())
+		// existing object "old" of 40 bytes pushed by a
+		if err := q.reserve("a", "old", 40); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.commit("old"); err != nil {
+			t.Fatal(err)
+		}
+		q.total = c.total
+		q.perPeer = c.perPeer
+		if allowed := q.allows(c.address, c.key, c.size); allowed != c.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", c.name, c.allowed, allowed)
+		}
+	}
+}
+
+func TestQuotasReserve(t *testing.T) {
+	dir := t.TempDir()
+	q := createQuotas(dir)
+	q.total = Quota{Bytes: 100}
+	check := func(step string, total Quota, peers map[string]Quota) {
+		if q.usage.Total != total {
+			t.Errorf("%s: expected total %+v, got %+v", step, total, q.usage.Total)
+		}
+		if len(q.usage.Peers) != len(peers) {
+			t.Errorf("%s: expected peers %+v, got %+v", step, peers, q.usage.Peers)
+		}
+		for address, used := range peers {
+			if q.usage.Peers[address] != used {
+				t.Errorf("%s: expected %s to use %+v, got %+v", step, address, used, q.usage.Peers[address])
+			}
+		}
+	}
+	if err := q.reserve("a", "x", 60); err != nil {
+		t.Fatal(err)
+	}
+	check("reserved", Quota{60, 1}, map[string]Quota{"a": {60, 1}})
+	// the reservation counts against further pushes
+	if err := q.reserve("b", "y", 50); err != errQuotaExceeded {
+		t.Errorf("expected errQuotaExceeded, got %v", err)
+	}
+	if err := q.reserve("b", "x", 10); err != errReserved {
+		t.Errorf("expected errReserved, got %v", err)
+	}
+	q.cancel("x")
+	check("cancelled", Quota{}, map[string]Quota{})
+	if err := q.reserve("a", "x", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.commit("x"); err != nil {
+		t.Fatal(err)
+	}
+	// a failed replacement restores the usage of the previous object
+	if err := q.reserve("b", "x", 30); err != nil {
+		t.Fatal(err)
+	}
+	check("replacing", Quota{30, 1}, map[string]Quota{"b": {30, 1}})
+	q.cancel("x")
+	check("replacement cancelled", Quota{60, 1}, map[string]Quota{"a": {60, 1}})
+	// usage survives a restart
+	restored := createQuotas(dir)
+	exists, err := restored.load()
+	if err != nil || !exists {
+		t.Fatalf("expected stored usage, got %v, %v", exists, err)
+	}
+	if restored.usage.Total != q.usage.Total {
+		t.Errorf("expected restored total %+v, got %+v", q.usage.Total, restored.usage.Total)
+	}
+	if err := q.release("x"); err != nil {
+		t.Fatal(err)
+	}
+	check("released", Quota{}, map[string]Quota{})
+	// releasing unknown objects is ignored
+	if err := q.release("unknown"); err != nil {
+		t.Errorf("expected no error releasing unknown object, got %v", err)
+	}
+}
+
+func TestQuotasReserveConcurrent(t *testing.T) {
+	q := createQuotas(t.TempDir())
+	q.total = Quota{Objects: 5}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var granted int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			if q.reserve("peer"+strconv.Itoa(i%3), key, 1) != nil {
+				return
+			}
+			if err := q.commit(key); err != nil {
+				t.Error(err)
+			}
+			mutex.Lock()
+			granted++
+			mutex.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	if granted != 5 || q.usage.Total.Objects != 5 {
+		t.Errorf("expected 5 stored objects, got %d granted and usage %+v", granted, q.usage.Total)
+	}
+}
+
+func TestQuotasSeed(t *testing.T) {
+	fs := createTestStorage(t)
+	for i := 0; i < 3; i++ {
+		if err := fs.Store("key"+strconv.Itoa(i), make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	enc := &Encrypted{storage: fs, quotas: createQuotas(dir)}
+	if err := enc.loadQuotas(); err != nil {
+		t.Fatal(err)
+	}
+	if enc.quotas.usage.Total != (Quota{30, 3}) || len(enc.quotas.usage.Peers) != 0 {
+		t.Errorf("expected existing objects counted without owner, got %+v", enc.quotas.usage)
+	}
+	// objects stored later must not be counted again on the next load
+	if err := fs.Store("later", make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	enc.quotas = createQuotas(dir)
+	if err := enc.loadQuotas(); err != nil {
+		t.Fatal(err)
+	}
+	if enc.quotas.usage.Total != (Quota{30, 3}) {
+		t.Errorf("expected stored usage to be kept, got %+v", enc.quotas.usage.Total)
+	}
+	// seeded objects are freed when removed
+	if err := enc.quotas.release("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if enc.quotas.usage.Total != (Quota{20, 2}) {
+		t.Errorf("expected seeded object to be released, got %+v", enc.quotas.usage.Total)
+	}
+}
@@ -0,0 +1,118 @@
+package encrypted
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+A peer is revoked once it is no longer trusted, because its peer file has been
+removed or marks it as untrusted. Peer files that merely fail to be read never
+revoke anyone. Revoking drops its connection, clears its lock, and cancels its
+transfers. Revoked addresses are persisted to revokedJSON in LOCALDIR and
+refused until they are reinstated, even if a peer file for them shows up again.
+*/
+
+/*
+Revoked returns the addresses of all revoked peers.
+*/
+func (enc *Encrypted) Revoked() []string {
+	enc.peers.mutex.RLock()
+	defer enc.peers.mutex.RUnlock()
+	var addresses []string
+	for address := range enc.peers.revoked {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+/*
+Reinstate removes the address from the revoked peers. It is accepted again as
+soon as a trusted peer file for it exists.
+*/
+func (enc *Encrypted) Reinstate(address string) error {
+	enc.peers.mutex.Lock()
+	delete(enc.peers.revoked, address)
+	enc.peers.mutex.Unlock()
+	err := enc.storeRevoked()
+	if err != nil {
+		return err
+	}
+	return enc.updatePeers()
+}
+
+/*
+isRevoked returns whether the address has been revoked.
+*/
+func (pl *peerList) isRevoked(address string) bool {
+	pl.mutex.RLock()
+	defer pl.mutex.RUnlock()
+	return pl.revoked[address]
+}
+
+/*
+revoke revokes the peer with the given address.
+*/
+func (enc *Encrypted) revoke(address string) {
+	enc.log("Revoking peer", address+".")
+	enc.peers.mutex.Lock()
+	enc.peers.revoked[address] = true
+	enc.peers.mutex.Unlock()
+	err := enc.storeRevoked()
+	if err != nil {
+		enc.warn("Failed to store revoked peers:", err.Error())
+	}
+	// drop the connection so that the peer can't reach us anymore
+	err = enc.channel.RemoveConnection(address)
+	if err != nil {
+		enc.warn("Failed to remove connection of revoked peer:", err.Error())
+	}
+	// clear its lock or place in the queue and cancel its transfers, including
+	// the ones already receiving data
+	enc.lock.leave(address)
+	_, next := enc.lock.release(address)
+	enc.onUnlocked([]string{address}, next)
+	enc.cInterface.dropAllowances(address)
+}
+
+/*
+storeRevoked writes the revoked peers to LOCALDIR.
+*/
+func (enc *Encrypted) storeRevoked() error {
+	data, err := json.MarshalIndent(enc.Revoked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	path := enc.RootPath + "/" + shared.LOCALDIR + "/" + revokedJSON
+	return writeFileAtomic(path, data)
+}
+
+/*
+loadRevoked reads the revoked peers from LOCALDIR. A missing file is not an
+error.
+*/
+func (enc *Encrypted) loadRevoked() error {
+	data, err := ioutil.ReadFile(enc.RootPath + "/" + shared.LOCALDIR + "/" + revokedJSON)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var addresses []string
+	err = json.Unmarshal(data, &addresses)
+	if err != nil {
+		return err
+	}
+	enc.peers.mutex.Lock()
+	defer enc.peers.mutex.Unlock()
+	for _, address := range addresses {
+		enc.peers.revoked[address] = true
+	}
+	return nil
+}
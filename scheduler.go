@@ -0,0 +1,192 @@
+package encrypted
+
+import "sync"
+
+/*
+scheduler limits how many transfers run at the same time, both per peer and in
+total. Transfers that can't start yet are queued and started in order of
+submission once a slot is free. Each transfer is identified by a key; a key
+that is already queued or running is not submitted again.
+*/
+type scheduler struct {
+	mutex    sync.Mutex
+	perPeer  int               // maximum running transfers per peer, zero for no limit
+	total    int               // maximum running transfers overall, zero for no limit
+	running  map[string]string // key to address of all running transfers
+	counts   map[string]int    // number of running transfers per address
+	queue    []*transfer       // transfers waiting for a free slot
+	starting bool              // whether queued transfers are currently being started
+}
+
+/*
+transfer is a single scheduled transfer. start is called once a slot is free and
+must return whether the transfer is running. If it is, done must be called with
+its key once it has finished.
+*/
+type transfer struct {
+	address string
+	key     string
+	start   func() bool
+}
+
+/*
+SetTransferLimits sets how many sends and receives may run at the same time per
+peer and in total. Zero means no limit. Further transfers are queued.
+*/
+func (enc *Encrypted) SetTransferLimits(sendsPerPeer, sends, receivesPerPeer, receives int) {
+	enc.cInterface.sends.setLimits(sendsPerPeer, sends)
+	enc.cInterface.receives.setLimits(receivesPerPeer, receives)
+}
+
+/*
+createScheduler returns a scheduler with the given limits.
+*/
+func createScheduler(perPeer, total int) *scheduler {
+	return &scheduler{
+		perPeer: perPeer,
+		total:   total,
+		running: make(map[string]string),
+		counts:  make(map[string]int)}
+}
+
+/*
+setLimits changes the limits. Queued transfers are started if the new limits
+allow it.
+*/
+func (s *scheduler) setLimits(perPeer, total int) {
+	s.mutex.Lock()
+	s.perPeer = perPeer
+	s.total = total
+	s.mutex.Unlock()
+	s.startQueued()
+}
+
+/*
+submit schedules a transfer. It is started right away if the limits allow it.
+*/
+func (s *scheduler) submit(address, key string, start func() bool) {
+	s.mutex.Lock()
+	if _, exists := s.running[key]; exists || s.queued(key) {
+		s.mutex.Unlock()
+		return
+	}
+	s.queue = append(s.queue, &transfer{
+		address: address,
+		key:     key,
+		start:   start})
+	s.mutex.Unlock()
+	s.startQueued()
+}
+
+/*
+done frees the slot of the transfer with the given key and starts queued
+transfers that can now run.
+*/
+func (s *scheduler) done(key string) {
+	s.release(key)
+	s.startQueued()
+}
+
+/*
+release frees the slot of the transfer with the given key.
+*/
+func (s *scheduler) release(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	address, exists := s.running[key]
+	if !exists {
+		return
+	}
+	delete(s.running, key)
+	s.counts[address]--
+	if s.counts[address] <= 0 {
+		delete(s.counts, address)
+	}
+}
+
+/*
+busy returns whether the address has running transfers.
+*/
+func (s *scheduler) busy(address string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counts[address] > 0
+}
+
+/*
+cancel removes all queued transfers of the given address. Running transfers are
+not affected.
+*/
+func (s *scheduler) cancel(address string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var queue []*transfer
+	for _, t := range s.queue {
+		if t.address != address {
+			queue = append(queue, t)
+		}
+	}
+	s.queue = queue
+}
+
+/*
+startQueued starts queued transfers in order for as long as the limits allow.
+Transfers of peers that are at their limit are skipped but keep their place.
+*/
+func (s *scheduler) startQueued() {
+	s.mutex.Lock()
+	// only one caller starts transfers at a time so that order is kept, it will
+	// also pick up any slots freed in the meantime
+	if s.starting {
+		s.mutex.Unlock()
+		return
+	}
+	s.starting = true
+	for {
+		next := s.next()
+		if next == nil {
+			s.starting = false
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+		if !next.start() {
+			s.release(next.key)
+		}
+		s.mutex.Lock()
+	}
+}
+
+/*
+next removes the first queued transfer that may run from the queue, marks it
+as running, and returns it. Returns nil if none may run. NOTE: the mutex must be
+held when calling this.
+*/
+func (s *scheduler) next() *transfer {
+	if s.total > 0 && len(s.running) >= s.total {
+		return nil
+	}
+	for i, t := range s.queue {
+		if s.perPeer > 0 && s.counts[t.address] >= s.perPeer {
+			continue
+		}
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		s.running[t.key] = t.address
+		s.counts[t.address]++
+		return t
+	}
+	return nil
+}
+
+/*
+queued returns whether a transfer with the given key is queued. NOTE: the mutex
+must be held when calling this.
+*/
+func (s *scheduler) queued(key string) bool {
+	for _, t := range s.queue {
+		if t.key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package encrypted
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSchedulerLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		perPeer  int
+		total    int
+		submits  []string // addresses submitting one transfer each, in order
+		expected []string // keys of the transfers started right away
+	}{
+		{"no limits", 0, 0, []string{"a", "a", "b"}, []string{"a0", "a1", "b2"}},
+		{"per peer", 1, 0, []string{"a", "a", "b"}, []string{"a0", "b2"}},
+		{"total", 0, 2, []string{"a", "b", "c"}, []string{"a0", "b1"}},
+		{"both", 1, 2, []string{"a", "a", "b", "c"}, []string{"a0", "b2"}},
+	}
+	for _, test := range tests {
+		s := createScheduler(test.perPeer, test.total)
+		var started []string
+		for i, address := range test.submits {
+			key := address + string(rune('0'+i))
+			s.submit(address, key, func() bool {
+				started = append(started, key)
+				return true
+			})
+		}
+		if !reflect.DeepEqual(started, test.expected) {
+			t.Errorf("%s: expected %v to start, got %v", test.name, test.expected, started)
+		}
+	}
+}
+
+func TestSchedulerQueue(t *testing.T) {
+	s := createScheduler(1, 0)
+	var started []string
+	start := func(key string) func() bool {
+		return func() bool {
+			started = append(started, key)
+			return true
+		}
+	}
+	s.submit("a", "a1", start("a1"))
+	s.submit("a", "a2", start("a2"))
+	s.submit("a", "a3", start("a3"))
+	// same key is only scheduled once
+	s.submit("a", "a2", start("a2"))
+	if !s.busy("a") || s.running["a1"] == "" || s.running["a2"] != "" {
+		t.Fatal("expected only a1 to run")
+	}
+	s.done("a1")
+	if !reflect.DeepEqual(started, []string{"a1", "a2"}) {
+		t.Fatalf("expected a2 to start after a1, got %v", started)
+	}
+	// canceled transfers never start
+	s.cancel("a")
+	s.done("a2")
+	if len(started) != 2 || s.busy("a") {
+		t.Errorf("expected a3 to be canceled, got %v", started)
+	}
+}
+
+func TestSchedulerFailedStart(t *testing.T) {
+	s := createScheduler(0, 1)
+	var started []string
+	s.submit("a", "a1", func() bool {
+		started = append(started, "a1")
+		return false
+	})
+	s.submit("b", "b1", func() bool {
+		started = append(started, "b1")
+		return true
+	})
+	// a failed start must free its slot right away
+	if !reflect.DeepEqual(started, []string{"a1", "b1"}) {
+		t.Errorf("expected both to start, got %v", started)
+	}
+}
+
+func TestSchedulerConcurrent(t *testing.T) {
+	s := createScheduler(2, 4)
+	var mutex sync.Mutex
+	running := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		address := string(rune('a' + i%4))
+		key := address + string(rune('0'+i))
+		s.submit(address, key, func() bool {
+			mutex.Lock()
+			running[address]++
+			if running[address] > 2 {
+				t.Errorf("too many transfers for %s", address)
+			}
+			mutex.Unlock()
+			go func() {
+				mutex.Lock()
+				running[address]--
+				mutex.Unlock()
+				s.done(key)
+				wg.Done()
+			}()
+			return true
+		})
+	}
+	wg.Wait()
+	if s.busy("a") || len(s.queue) != 0 {
+		t.Error("transfers left after all are done")
+	}
+}
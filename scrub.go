@@ -0,0 +1,305 @@
+package encrypted
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+ScrubReport is the result of a scrub run.
+*/
+type ScrubReport struct {
+	Started  time.Time // when the run was started
+	Finished time.Time // when the run was finished, zero if aborted or still running
+	Checked  int       // number of objects verified
+	Recorded int       // number of objects that had no checksum yet
+	Damaged  []string  // identifications of objects that failed verification
+}
+
+/*
+scrubber holds the configuration and state of the background scrub job.
+*/
+type scrubber struct {
+	mutex    sync.Mutex
+	interval time.Duration // how long to wait between two runs
+	rate     int64         // maximum bytes read per second
+	running  bool          // whether a run is currently in progress
+	lastRun  time.Time     // when the last run was started
+	report   *ScrubReport  // report of the last finished run
+}
+
+/*
+createScrubber returns a scrubber with the default configuration.
+*/
+func createScrubber() *scrubber {
+	return &scrubber{
+		interval: scrubInterval,
+		rate:     scrubRate,
+		lastRun:  time.Now()}
+}
+
+/*
+SetScrubInterval sets how often the storage is scrubbed. An interval of zero
+disables scrubbing.
+*/
+func (enc *Encrypted) SetScrubInterval(interval time.Duration) {
+	enc.scrubber.mutex.Lock()
+	enc.scrubber.interval = interval
+	enc.scrubber.mutex.Unlock()
+}
+
+/*
+SetScrubRate sets the maximum number of bytes per second read while scrubbing.
+*/
+func (enc *Encrypted) SetScrubRate(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		return
+	}
+	enc.scrubber.mutex.Lock()
+	enc.scrubber.rate = bytesPerSecond
+	enc.scrubber.mutex.Unlock()
+}
+
+/*
+LastScrub returns the report of the last finished scrub run, or nil if none has
+finished yet.
+*/
+func (enc *Encrypted) LastScrub() *ScrubReport {
+	enc.scrubber.mutex.Lock()
+	defer enc.scrubber.mutex.Unlock()
+	return enc.scrubber.report
+}
+
+/*
+startScrub starts a scrub run in the background if one is due and none is
+running yet. The run is aborted once quit is closed.
+*/
+func (enc *Encrypted) startScrub(quit <-chan bool) {
+	enc.scrubber.mutex.Lock()
+	due := enc.scrubber.interval > 0 && time.Since(enc.scrubber.lastRun) >= enc.scrubber.interval
+	if enc.scrubber.running || !due {
+		enc.scrubber.mutex.Unlock()
+		return
+	}
+	enc.scrubber.running = true
+	enc.scrubber.lastRun = time.Now()
+	enc.scrubber.mutex.Unlock()
+	enc.wg.Add(1)
+	go func() {
+		defer enc.wg.Done()
+		report := enc.scrub(quit)
+		enc.scrubber.mutex.Lock()
+		enc.scrubber.running = false
+		if !report.Finished.IsZero() {
+			enc.scrubber.report = report
+		}
+		enc.scrubber.mutex.Unlock()
+	}()
+}
+
+/*
+scrub re-reads and verifies all stored data. Objects that fail verification are
+moved to quarantine, data without checksum has it recorded.
+*/
+func (enc *Encrypted) scrub(quit <-chan bool) *ScrubReport {
+	report := &ScrubReport{Started: time.Now()}
+	enc.log("Scrub started.")
+	// control files are never quarantined as they are required for syncing
+	controls := map[string]shared.ObjectType{
+		shared.IDMODEL:  shared.OtModel,
+		shared.AUTHJSON: shared.OtAuth}
+	paths := map[string]string{
+		shared.IDMODEL:  enc.RootPath + "/" + shared.IDMODEL,
+		shared.AUTHJSON: enc.RootPath + "/" + shared.ORGDIR + "/" + shared.AUTHJSON}
+	peersPath := enc.RootPath + "/" + shared.ORGDIR + "/" + shared.PEERSDIR
+	peerFiles, err := ioutil.ReadDir(peersPath)
+	if err != nil {
+		enc.warn("Scrub failed to read peers:", err.Error())
+	}
+	for _, stat := range peerFiles {
+		controls[stat.Name()] = shared.OtPeer
+		paths[stat.Name()] = peersPath + "/" + stat.Name()
+	}
+	for identification, objType := range controls {
+		path := paths[identification]
+		damaged, err := enc.scrubOne(objType, identification, func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}, report, quit)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == errScrubAborted {
+			enc.log("Scrub aborted.")
+			return report
+		}
+		if err != nil {
+			enc.warn("Scrub failed to verify", identification+":", err.Error())
+			continue
+		}
+		if damaged {
+			enc.warn("Scrub found damaged", identification+"!")
+		}
+	}
+	// now all objects in storage
+	err = enc.walkStorage(func(info KeyInfo) error {
+		damaged, err := enc.scrubOne(shared.OtObject, info.Key, func() (io.ReadCloser, error) {
+			return enc.retrieveObject(info.Key)
+		}, report, quit)
+		if err == errScrubAborted {
+			return err
+		}
+		if err != nil {
+			enc.warn("Scrub failed to verify", info.Key+":", err.Error())
+			return nil
+		}
+		// objects that are being pushed right now are replaced anyway
+		if damaged && enc.cInterface.receiving(info.Key) {
+			enc.warn("Scrub found damaged object", info.Key+", but it is being replaced.")
+			return nil
+		}
+		if damaged {
+			enc.warn("Scrub found damaged object", info.Key+", moving to quarantine.")
+			err = enc.quarantine(info.Key)
+			if err != nil {
+				enc.warn("Scrub failed to quarantine", info.Key+":", err.Error())
+			}
+		}
+		return nil
+	})
+	if err == errScrubAborted {
+		enc.log("Scrub aborted.")
+		return report
+	}
+	if err != nil {
+		enc.warn("Scrub failed to walk storage:", err.Error())
+	}
+	report.Finished = time.Now()
+	enc.log("Scrub checked", strconv.Itoa(report.Checked), "objects,", strconv.Itoa(len(report.Damaged)), "damaged.")
+	return report
+}
+
+/*
+scrubOne verifies the data read from the reader returned by open against the
+recorded checksum at the configured rate. If no checksum exists yet it is
+recorded. Returns true if the data is damaged. As the data may be replaced while
+it is read, objects whose checksum changed in the meantime are skipped and
+damage is only reported once it has been confirmed by reading the data again.
+*/
+func (enc *Encrypted) scrubOne(objType shared.ObjectType, identification string, open func() (io.ReadCloser, error), report *ScrubReport, quit <-chan bool) (bool, error) {
+	enc.scrubber.mutex.Lock()
+	rate := enc.scrubber.rate
+	enc.scrubber.mutex.Unlock()
+	before, err := enc.checksums.get(objType, identification)
+	if err != nil {
+		return false, err
+	}
+	reader, err := open()
+	if err != nil {
+		return false, err
+	}
+	hr := createHashingReader(&throttledReader{
+		reader: reader,
+		rate:   rate,
+		start:  time.Now(),
+		quit:   quit})
+	_, err = io.Copy(ioutil.Discard, hr)
+	reader.Close()
+	if err != nil {
+		return false, err
+	}
+	recorded, err := enc.checksums.get(objType, identification)
+	if err != nil {
+		return false, err
+	}
+	// replaced while reading, the new data is verified by the next run
+	if recorded != before {
+		return false, nil
+	}
+	report.Checked++
+	if recorded == "" {
+		report.Recorded++
+		return false, enc.checksums.set(objType, identification, hr.Sum())
+	}
+	if recorded == hr.Sum() {
+		return false, nil
+	}
+	damaged, err := enc.confirmDamage(objType, identification, recorded, open)
+	if err != nil || !damaged {
+		return false, err
+	}
+	report.Damaged = append(report.Damaged, identification)
+	return true, nil
+}
+
+/*
+confirmDamage reads the data again at full speed and returns whether it still
+doesn't match the recorded checksum, which must also be unchanged.
+*/
+func (enc *Encrypted) confirmDamage(objType shared.ObjectType, identification, recorded string, open func() (io.ReadCloser, error)) (bool, error) {
+	reader, err := open()
+	if err != nil {
+		return false, err
+	}
+	hr := createHashingReader(reader)
+	_, err = io.Copy(ioutil.Discard, hr)
+	reader.Close()
+	if err != nil {
+		return false, err
+	}
+	current, err := enc.checksums.get(objType, identification)
+	if err != nil {
+		return false, err
+	}
+	return current == recorded && hr.Sum() != recorded, nil
+}
+
+/*
+throttledReader limits the rate at which data can be read from the wrapped
+reader. Reading fails with errScrubAborted once quit is closed.
+*/
+type throttledReader struct {
+	reader io.Reader
+	rate   int64     // bytes per second
+	start  time.Time // when reading started
+	read   int64     // bytes read so far
+	quit   <-chan bool
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	select {
+	case <-tr.quit:
+		return 0, errScrubAborted
+	default:
+	}
+	// never read more than a tenth of a second worth of data at once
+	if max := tr.rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := tr.reader.Read(p)
+	tr.read += int64(n)
+	// wait until the read data is within the rate
+	if wait := tr.wait(); wait > 0 {
+		select {
+		case <-tr.quit:
+			return n, errScrubAborted
+		case <-time.After(wait):
+		}
+	}
+	return n, err
+}
+
+/*
+wait returns how long to wait until the data read so far is within the rate.
+Computed in floating point as the byte count times a second overflows for
+large objects.
+*/
+func (tr *throttledReader) wait() time.Duration {
+	due := time.Duration(float64(tr.read) / float64(tr.rate) * float64(time.Second))
+	return due - time.Since(tr.start)
+}
@@ -0,0 +1,29 @@
+package encrypted
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottledReaderWait(t *testing.T) {
+	cases := []struct {
+		read     int64
+		rate     int64
+		expected time.Duration
+	}{
+		{0, 1 << 20, 0},
+		{1 << 20, 1 << 20, time.Second},
+		{1 << 30, 4 << 20, 256 * time.Second},
+		// beyond 9.2 GB multiplying by a second overflows
+		{10 << 30, 4 << 20, 2560 * time.Second},
+		{1 << 40, 1 << 20, 1 << 20 * time.Second},
+	}
+	for _, c := range cases {
+		tr := &throttledReader{rate: c.rate, read: c.read, start: time.Now()}
+		wait := tr.wait()
+		// allow for the time passed since start
+		if wait > c.expected || wait < c.expected-time.Second {
+			t.Errorf("read %d at %d/s: expected wait of %v, got %v", c.read, c.rate, c.expected, wait)
+		}
+	}
+}
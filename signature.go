@@ -0,0 +1,234 @@
+package encrypted
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Auth and peer files control who belongs to the network, so changes to them must
+be signed by a trusted peer. The signing peer is given by its address in the
+Signer field of the push or notify, the hex encoded ed25519 signature over the
+content built by signedContent in the Signature field. The public keys of the
+peers allowed to sign are registered in the signersJSON file within ORGDIR. As
+long as no key is registered all changes are refused, unless the operator
+explicitly allows unsigned changes to set up a new network.
+
+Every signature covers a version that must be higher than that of the last
+accepted change to the same file, so that a signed change can't be replayed.
+Signing peers are expected to use the time of signing. The accepted versions are
+recorded in the versionsJSON file within LOCALDIR.
+*/
+
+/*
+AllowUnsignedChanges sets whether changes to the auth and peer files are
+accepted without a signature as long as no signer has been registered. Meant
+for setting up a new network only, as any trusted peer can then replace them.
+*/
+func (enc *Encrypted) AllowUnsignedChanges(allow bool) {
+	enc.signMutex.Lock()
+	defer enc.signMutex.Unlock()
+	enc.allowUnsigned = allow
+}
+
+/*
+AddSigner registers the ed25519 public key of the peer with the given address
+for verifying changes to the auth and peer files.
+*/
+func (enc *Encrypted) AddSigner(address string, key ed25519.PublicKey) error {
+	if address == "" || len(key) != ed25519.PublicKeySize {
+		return shared.ErrIllegalParameters
+	}
+	signers, err := enc.loadSigners()
+	if err != nil {
+		return err
+	}
+	signers[address] = hex.EncodeToString(key)
+	return enc.storeSigners(signers)
+}
+
+/*
+RemoveSigner removes the registered key of the peer with the given address.
+*/
+func (enc *Encrypted) RemoveSigner(address string) error {
+	signers, err := enc.loadSigners()
+	if err != nil {
+		return err
+	}
+	delete(signers, address)
+	return enc.storeSigners(signers)
+}
+
+/*
+signedContent returns the data that is signed for a change to a control file.
+sum is the checksum of the new content, or empty for a removal.
+*/
+func signedContent(objType shared.ObjectType, identification, sum string, version uint64) []byte {
+	return []byte(versionKey(objType, identification) + ":" + sum + ":" + strconv.FormatUint(version, 10))
+}
+
+/*
+applySigned carries out a change to the given file by calling apply if it is
+signed correctly, see verifySignature. The version of the change is only
+recorded once apply succeeded, so that a failed change can be retried. Changes
+to control files are serialized so that an older change can't overtake a newer
+one. Returns whether the signature was valid and any error.
+*/
+func (enc *Encrypted) applySigned(objType shared.ObjectType, identification, sum string, version uint64, signer, signature string, apply func() error) (bool, error) {
+	if !signed(objType) {
+		return true, apply()
+	}
+	enc.signMutex.Lock()
+	defer enc.signMutex.Unlock()
+	err := enc.verifySignature(objType, identification, sum, version, signer, signature)
+	if err != nil {
+		return false, err
+	}
+	err = apply()
+	if err != nil {
+		return true, err
+	}
+	return true, enc.recordVersion(objType, identification, version)
+}
+
+/*
+signed returns whether changes to objects of the given type must be signed.
+*/
+func signed(objType shared.ObjectType) bool {
+	return objType == shared.OtAuth || objType == shared.OtPeer
+}
+
+/*
+verifySignature checks that the change to the given control file is signed by a
+registered key of a trusted peer whose role allows the change and that its
+version is newer than that of any change accepted before. NOTE: signMutex must
+be held when calling this.
+*/
+func (enc *Encrypted) verifySignature(objType shared.ObjectType, identification, sum string, version uint64, signer, signature string) error {
+	signers, err := enc.loadSigners()
+	if err != nil {
+		return err
+	}
+	if len(signers) == 0 {
+		if !enc.allowUnsigned {
+			return errNoSigners
+		}
+		enc.warn("No signers registered, accepting unsigned change to", identification+"!")
+		return nil
+	}
+	encodedKey, exists := signers[signer]
+	if !exists || !enc.isAuthorized(signer) || !enc.peers.role(signer).includes(requiredRole(true, objType)) {
+		return errInvalidSignature
+	}
+	key, err := hex.DecodeString(encodedKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errInvalidSignature
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), signedContent(objType, identification, sum, version), sig) {
+		return errInvalidSignature
+	}
+	versions, err := enc.loadVersions()
+	if err != nil {
+		return err
+	}
+	if version <= versions[versionKey(objType, identification)] {
+		return errReplayed
+	}
+	return nil
+}
+
+/*
+recordVersion records the version of an applied change to the given control
+file. NOTE: signMutex must be held when calling this.
+*/
+func (enc *Encrypted) recordVersion(objType shared.ObjectType, identification string, version uint64) error {
+	versions, err := enc.loadVersions()
+	if err != nil {
+		return err
+	}
+	name := versionKey(objType, identification)
+	if version <= versions[name] {
+		return nil
+	}
+	versions[name] = version
+	return enc.storeVersions(versions)
+}
+
+/*
+versionKey returns the key identifying the given control file, both in signed
+content and for recording its version.
+*/
+func versionKey(objType shared.ObjectType, identification string) string {
+	return strconv.Itoa(int(objType)) + ":" + identification
+}
+
+/*
+loadVersions reads the versions of the last accepted changes from LOCALDIR. A
+missing file means that no change has been accepted yet.
+*/
+func (enc *Encrypted) loadVersions() (map[string]uint64, error) {
+	versions := make(map[string]uint64)
+	data, err := ioutil.ReadFile(enc.RootPath + "/" + shared.LOCALDIR + "/" + versionsJSON)
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &versions)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+/*
+storeVersions writes the versions of the last accepted changes to LOCALDIR.
+*/
+func (enc *Encrypted) storeVersions(versions map[string]uint64) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := enc.RootPath + "/" + shared.LOCALDIR + "/" + versionsJSON
+	return writeFileAtomic(path, data)
+}
+
+/*
+loadSigners reads the registered keys from ORGDIR. A missing file means that no
+keys have been registered.
+*/
+func (enc *Encrypted) loadSigners() (map[string]string, error) {
+	signers := make(map[string]string)
+	data, err := ioutil.ReadFile(enc.RootPath + "/" + shared.ORGDIR + "/" + signersJSON)
+	if os.IsNotExist(err) {
+		return signers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &signers)
+	if err != nil {
+		return nil, err
+	}
+	return signers, nil
+}
+
+/*
+storeSigners writes the registered keys to ORGDIR.
+*/
+func (enc *Encrypted) storeSigners(signers map[string]string) error {
+	data, err := json.MarshalIndent(signers, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := enc.RootPath + "/" + shared.ORGDIR + "/" + signersJSON
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,93 @@
+package encrypted
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestVerifySignature(t *testing.T) {
+	enc := createTestEncrypted(t)
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(objType shared.ObjectType, identification, sum string, version uint64) string {
+		return hex.EncodeToString(ed25519.Sign(private, signedContent(objType, identification, sum, version)))
+	}
+	apply := func(objType shared.ObjectType, identification, sum string, version uint64, signer, signature string) error {
+		_, err := enc.applySigned(objType, identification, sum, version, signer, signature, func() error { return nil })
+		return err
+	}
+	// without signers changes are refused unless explicitly allowed
+	if err := apply(shared.OtPeer, "peer", "sum", 0, "", ""); err != errNoSigners {
+		t.Errorf("expected errNoSigners, got %v", err)
+	}
+	enc.AllowUnsignedChanges(true)
+	if err := apply(shared.OtPeer, "peer", "sum", 0, "", ""); err != nil {
+		t.Errorf("expected unsigned change to be allowed, got %v", err)
+	}
+	// objects are never signed
+	enc.AllowUnsignedChanges(false)
+	if err := apply(shared.OtObject, "object", "sum", 0, "", ""); err != nil {
+		t.Errorf("expected objects to be accepted, got %v", err)
+	}
+	if err := enc.AddSigner(testAddress, public); err != nil {
+		t.Fatal(err)
+	}
+	enc.AllowUnsignedChanges(true)
+	cases := []struct {
+		name      string
+		objType   shared.ObjectType
+		id        string
+		sum       string
+		version   uint64
+		signer    string
+		signature string
+		expected  error
+	}{
+		{"unsigned once a signer exists", shared.OtPeer, "peer", "a", 1, "", "", errInvalidSignature},
+		{"unknown signer", shared.OtPeer, "peer", "a", 1, "unknown", sign(shared.OtPeer, "peer", "a", 1), errInvalidSignature},
+		{"different content", shared.OtPeer, "peer", "b", 1, testAddress, sign(shared.OtPeer, "peer", "a", 1), errInvalidSignature},
+		{"different version", shared.OtPeer, "peer", "a", 2, testAddress, sign(shared.OtPeer, "peer", "a", 1), errInvalidSignature},
+		{"different type", shared.OtAuth, "peer", "a", 1, testAddress, sign(shared.OtPeer, "peer", "a", 1), errInvalidSignature},
+		{"valid", shared.OtPeer, "peer", "a", 5, testAddress, sign(shared.OtPeer, "peer", "a", 5), nil},
+		{"replayed", shared.OtPeer, "peer", "a", 5, testAddress, sign(shared.OtPeer, "peer", "a", 5), errReplayed},
+		{"older version", shared.OtPeer, "peer", "b", 4, testAddress, sign(shared.OtPeer, "peer", "b", 4), errReplayed},
+		{"newer version", shared.OtPeer, "peer", "b", 6, testAddress, sign(shared.OtPeer, "peer", "b", 6), nil},
+		{"removal", shared.OtPeer, "peer", "", 7, testAddress, sign(shared.OtPeer, "peer", "", 7), nil},
+		{"replayed removal", shared.OtPeer, "peer", "", 7, testAddress, sign(shared.OtPeer, "peer", "", 7), errReplayed},
+		{"other file keeps own version", shared.OtAuth, "auth", "a", 1, testAddress, sign(shared.OtAuth, "auth", "a", 1), nil},
+	}
+	for _, c := range cases {
+		err := apply(c.objType, c.id, c.sum, c.version, c.signer, c.signature)
+		if err != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, err)
+		}
+	}
+	// a change that fails to be applied can be retried
+	failed := errors.New("failed")
+	verified, err := enc.applySigned(shared.OtAuth, "auth", "b", 2, testAddress, sign(shared.OtAuth, "auth", "b", 2), func() error { return failed })
+	if !verified || err != failed {
+		t.Errorf("expected failure of verified change, got %v, %v", verified, err)
+	}
+	if err := apply(shared.OtAuth, "auth", "b", 2, testAddress, sign(shared.OtAuth, "auth", "b", 2)); err != nil {
+		t.Errorf("expected retry of failed change to be accepted, got %v", err)
+	}
+	// invalid changes are never applied
+	verified, _ = enc.applySigned(shared.OtAuth, "auth", "c", 2, testAddress, sign(shared.OtAuth, "auth", "c", 2), func() error {
+		t.Error("replayed change was applied")
+		return nil
+	})
+	if verified {
+		t.Error("expected replayed change not to be verified")
+	}
+	// signers whose peer is no longer trusted can't sign
+	enc.peers.revoked[testAddress] = true
+	if err := apply(shared.OtPeer, "peer", "c", 8, testAddress, sign(shared.OtPeer, "peer", "c", 8)); err != errInvalidSignature {
+		t.Errorf("expected errInvalidSignature for revoked signer, got %v", err)
+	}
+}
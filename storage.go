@@ -1,5 +1,10 @@
 package encrypted
 
+import (
+	"io"
+	"time"
+)
+
 /*
 Storage is the interface a struct must satisfy to allow encrypted to use it as a
 storage backend.
@@ -12,3 +17,46 @@ type Storage interface {
 	/*Remove is called to remove a key and associated data from storage.*/
 	Remove(key string) error
 }
+
+/*
+Lister is an optional interface a Storage can implement to allow encrypted to
+enumerate the keys it holds.
+*/
+type Lister interface {
+	/*List returns up to limit keys that follow the given key. The order is up to
+	the storage but must be stable between calls. An empty after starts at the
+	beginning, an empty result signals that there are no more keys.*/
+	List(after string, limit int) ([]KeyInfo, error)
+}
+
+/*
+KeyInfo describes a single key held by a storage.
+*/
+type KeyInfo struct {
+	Key     string    // the key
+	Size    int64     // size of the stored data in bytes
+	ModTime time.Time // time the data was last written
+}
+
+/*
+Streamer is an optional interface a Storage can implement to allow encrypted to
+read and write data without holding it in memory completely.
+*/
+type Streamer interface {
+	/*StoreStream writes all data read from the reader to the key.*/
+	StoreStream(key string, reader io.Reader) error
+	/*RetrieveStream opens the data for a key for reading. The caller must close
+	the returned reader.*/
+	RetrieveStream(key string) (io.ReadCloser, error)
+}
+
+/*
+Locator is an optional interface a Storage can implement if it keeps its data in
+files on the local file system. Encrypted then sends objects directly from these
+files instead of copying them first. The file must not be modified in place
+while it exists, only replaced.
+*/
+type Locator interface {
+	/*Locate returns the path of the file holding the data of a key.*/
+	Locate(key string) (string, error)
+}